@@ -0,0 +1,125 @@
+package raft
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// Config holds the tunable parameters of a ConsensusModule. Start from
+// DefaultConfig and override what needs changing.
+type Config struct {
+	// HeartbeatInterval is how often a leader sends AppendEntries to its
+	// followers when it has nothing new for them.
+	HeartbeatInterval time.Duration
+
+	// A follower that hears nothing from a leader for a random duration in
+	// [ElectionTimeoutMin, ElectionTimeoutMax) starts an election.
+	ElectionTimeoutMin time.Duration
+	ElectionTimeoutMax time.Duration
+
+	// MaxEntriesPerAppend and MaxBytesPerAppend limit the entries sent in
+	// one AppendEntries RPC, by number and by size; zero means no limit. The
+	// size of an entry is its Data plus a small fixed overhead, so commands
+	// submitted as Go values rather than with SubmitData only count towards
+	// MaxEntriesPerAppend in practice, which is why DefaultConfig sets both.
+	// An entry larger than MaxBytesPerAppend is sent on its own.
+	MaxEntriesPerAppend int
+	MaxBytesPerAppend   int
+
+	// MaxInflightAppends is how many AppendEntries RPCs carrying entries a
+	// leader has in flight to a follower at most.
+	MaxInflightAppends int
+
+	// AppendBatchDelay is how long a leader waits before replicating a
+	// Submit, so that the ones following it go out in the same AppendEntries.
+	// Zero sends each straight away.
+	AppendBatchDelay time.Duration
+
+	// CommitChanBuffer is how many commit notifications can queue up for the
+	// goroutine that applies entries. Any more are dropped, since one that is
+	// pending already makes it catch up.
+	CommitChanBuffer int
+
+	// Logger receives the debug log. Nil means the standard logger.
+	Logger *log.Logger
+
+	// PreVote and LeaseRead enable the features described at SetPreVote and
+	// SetLeaseRead, with MaxClockDrift bounding the clock drift for the latter.
+	// LeaseRead must be the same on every server.
+	PreVote       bool
+	LeaseRead     bool
+	MaxClockDrift time.Duration
+
+	// ForwardTimeout bounds how long a Server that is not the leader waits
+	// for the leader to answer a Submit it forwarded.
+	ForwardTimeout time.Duration
+
+	// RandSeed seeds the source of the election timeouts, mixed with the
+	// server's id so that servers sharing a Config don't all time out
+	// together. Zero seeds it from the clock. Passing the seed of a
+	// SimNetwork makes a simulated run replayable.
+	RandSeed int64
+}
+
+func DefaultConfig() Config {
+	return Config{
+		HeartbeatInterval:   HeartbeatTimeout * TimeoutUnit,
+		ElectionTimeoutMin:  ElectionTimeoutMin * TimeoutUnit,
+		ElectionTimeoutMax:  ElectionTimeoutMax * TimeoutUnit,
+		MaxEntriesPerAppend: 64,
+		MaxBytesPerAppend:   1 << 20,
+		MaxInflightAppends:  8,
+		AppendBatchDelay:    AppendBatchDelay * TimeoutUnit,
+		CommitChanBuffer:    16,
+		ForwardTimeout:      ForwardTimeout * TimeoutUnit,
+	}
+}
+
+// Validate reports the first problem with c, if any.
+func (c Config) Validate() error {
+	if c.HeartbeatInterval <= 0 {
+		return fmt.Errorf("raft: heartbeat interval %v must be positive", c.HeartbeatInterval)
+	}
+	if c.ElectionTimeoutMin <= 0 || c.ElectionTimeoutMax <= c.ElectionTimeoutMin {
+		return fmt.Errorf("raft: election timeout range [%v, %v) must be positive and non-empty", c.ElectionTimeoutMin, c.ElectionTimeoutMax)
+	}
+	// Followers must get a few heartbeats in before they time out, or one
+	// slow message triggers an election.
+	if 2*c.HeartbeatInterval > c.ElectionTimeoutMin {
+		return fmt.Errorf("raft: heartbeat interval %v must be at most half the minimum election timeout %v", c.HeartbeatInterval, c.ElectionTimeoutMin)
+	}
+	if c.MaxEntriesPerAppend < 0 {
+		return fmt.Errorf("raft: max entries per AppendEntries %d must not be negative", c.MaxEntriesPerAppend)
+	}
+	if c.MaxBytesPerAppend < 0 {
+		return fmt.Errorf("raft: max bytes per AppendEntries %d must not be negative", c.MaxBytesPerAppend)
+	}
+	if c.MaxInflightAppends < 1 {
+		return fmt.Errorf("raft: max in-flight AppendEntries %d must be at least 1", c.MaxInflightAppends)
+	}
+	if c.AppendBatchDelay < 0 || c.AppendBatchDelay >= c.HeartbeatInterval {
+		return fmt.Errorf("raft: append batch delay %v must be in [0, %v)", c.AppendBatchDelay, c.HeartbeatInterval)
+	}
+	if c.CommitChanBuffer < 1 {
+		return fmt.Errorf("raft: commit channel buffer %d must be at least 1", c.CommitChanBuffer)
+	}
+	if c.ForwardTimeout <= 0 {
+		return fmt.Errorf("raft: forward timeout %v must be positive", c.ForwardTimeout)
+	}
+	return validateClockDrift(c.MaxClockDrift, c.ElectionTimeoutMin)
+}
+
+func validateClockDrift(maxClockDrift, electionTimeoutMin time.Duration) error {
+	if maxClockDrift < 0 || maxClockDrift >= electionTimeoutMin {
+		return fmt.Errorf("raft: clock drift bound %v must be in [0, %v)", maxClockDrift, electionTimeoutMin)
+	}
+	return nil
+}
+
+func (c Config) logger() *log.Logger {
+	if c.Logger == nil {
+		return log.Default()
+	}
+	return c.Logger
+}
@@ -0,0 +1,75 @@
+package raft
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConfigValidate(t *testing.T) {
+	if err := DefaultConfig().Validate(); err != nil {
+		t.Fatalf("default config is invalid: %v", err)
+	}
+	bad := map[string]func(*Config){
+		"zero heartbeat":        func(c *Config) { c.HeartbeatInterval = 0 },
+		"empty election range":  func(c *Config) { c.ElectionTimeoutMax = c.ElectionTimeoutMin },
+		"slow heartbeat":        func(c *Config) { c.HeartbeatInterval = c.ElectionTimeoutMin },
+		"negative max entries":  func(c *Config) { c.MaxEntriesPerAppend = -1 },
+		"negative max bytes":    func(c *Config) { c.MaxBytesPerAppend = -1 },
+		"no in-flight appends":  func(c *Config) { c.MaxInflightAppends = 0 },
+		"slow batching":         func(c *Config) { c.AppendBatchDelay = c.HeartbeatInterval },
+		"unbuffered commits":    func(c *Config) { c.CommitChanBuffer = 0 },
+		"clock drift too large": func(c *Config) { c.MaxClockDrift = c.ElectionTimeoutMin },
+		"zero forward timeout":  func(c *Config) { c.ForwardTimeout = 0 },
+	}
+	for name, mutate := range bad {
+		config := DefaultConfig()
+		mutate(&config)
+		if err := config.Validate(); err == nil {
+			t.Errorf("%s: Validate accepted %+v", name, config)
+		}
+		if _, err := NewServer(0, []int{1}, config, NewMapStorage(), nil, nil); err == nil {
+			t.Errorf("%s: NewServer accepted %+v", name, config)
+		}
+	}
+}
+
+// A cluster with long timeouts and small AppendEntries batches runs next to
+// the default one in the same process.
+func TestConfigPerCluster(t *testing.T) {
+	config := DefaultConfig()
+	config.HeartbeatInterval = 100 * time.Millisecond
+	config.ElectionTimeoutMin = 600 * time.Millisecond
+	config.ElectionTimeoutMax = 900 * time.Millisecond
+	config.MaxEntriesPerAppend = 1
+
+	network := NewInmemNetwork()
+	cms, commitChans, stop := startInmemCluster(t, network, 3, config)
+	defer stop()
+
+	start := time.Now()
+	leaderId := waitForLeader(cms)
+	if leaderId < 0 {
+		t.Fatalf("no leader elected")
+	}
+	if elapsed := time.Since(start); elapsed < config.ElectionTimeoutMin {
+		t.Errorf("leader elected after %v, before the minimum election timeout", elapsed)
+	}
+
+	for i := 0; i < 5; i++ {
+		if _, _, isLeader := cms[leaderId].Submit(i); !isLeader {
+			t.Fatalf("leader %d refused Submit", leaderId)
+		}
+	}
+	for id := range cms {
+		for i := 0; i < 5; i++ {
+			select {
+			case entry := <-commitChans[id]:
+				if entry.Command != i {
+					t.Errorf("server %d committed %v, want %d", id, entry.Command, i)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("server %d did not commit command %d", id, i)
+			}
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package raft
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// AnyPeer matches RPCs from every peer in a FaultRule.
+const AnyPeer = -1
+
+// FaultRule describes how RPCs matching it are disturbed. A matching RPC is
+// dropped with probability DropRate, after hanging for DropDelay; otherwise
+// it is delayed by [DelayMin, DelayMax) with probability DelayRate, and by
+// [LatencyMin, LatencyMax) if not.
+type FaultRule struct {
+	// Peer is the id of the sending server, or AnyPeer.
+	Peer int
+	// Method is an RPC name such as "AppendEntries", or "" for any RPC.
+	Method string
+
+	DropRate  float64
+	DropDelay time.Duration
+
+	DelayRate          float64
+	DelayMin, DelayMax time.Duration
+
+	LatencyMin, LatencyMax time.Duration
+}
+
+// UnreliableFaultRule is the network the test Harness simulates by default:
+// about 10% of RPCs fail, and a fifth of the rest are held up for a while.
+func UnreliableFaultRule() FaultRule {
+	return FaultRule{
+		Peer:       AnyPeer,
+		DropRate:   MockUnreliableRpcFailureRate,
+		DropDelay:  MockUnreliableRpcFailureDuration * TimeoutUnit,
+		DelayRate:  MockUnreliableRpcDelayRate,
+		DelayMin:   MockUnreliableRpcDelayMin * TimeoutUnit,
+		DelayMax:   MockUnreliableRpcDelayMax * TimeoutUnit,
+		LatencyMin: MockUnreliableRpcLatencyMin * TimeoutUnit,
+		LatencyMax: MockUnreliableRpcLatencyMax * TimeoutUnit,
+	}
+}
+
+func (r FaultRule) matches(peerId int, method string) bool {
+	return (r.Peer == AnyPeer || r.Peer == peerId) && (r.Method == "" || r.Method == method)
+}
+
+// FaultPolicy decides which incoming RPCs a Server drops or delays. It is
+// disabled unless enabled with SetEnabled, in which case an RPC follows the
+// first rule added with AddRule that matches it, or the default rule.
+type FaultPolicy struct {
+	mu          sync.Mutex
+	enabled     bool
+	rules       []FaultRule
+	defaultRule FaultRule
+}
+
+// NewFaultPolicy returns a disabled policy whose default rule is
+// UnreliableFaultRule.
+func NewFaultPolicy() *FaultPolicy {
+	return &FaultPolicy{defaultRule: UnreliableFaultRule()}
+}
+
+func (fp *FaultPolicy) SetEnabled(enabled bool) {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	fp.enabled = enabled
+}
+
+func (fp *FaultPolicy) Enabled() bool {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	return fp.enabled
+}
+
+// SetDefault sets the rule for RPCs that match no other rule. Its Peer and
+// Method are ignored.
+func (fp *FaultPolicy) SetDefault(rule FaultRule) {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	fp.defaultRule = rule
+}
+
+// AddRule adds a rule, taking precedence over the default and over the rules
+// added after it.
+func (fp *FaultPolicy) AddRule(rule FaultRule) {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	fp.rules = append(fp.rules, rule)
+}
+
+func (fp *FaultPolicy) ClearRules() {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	fp.rules = nil
+}
+
+func (fp *FaultPolicy) rule(peerId int, method string) (FaultRule, bool) {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	if !fp.enabled {
+		return FaultRule{}, false
+	}
+	for _, r := range fp.rules {
+		if r.matches(peerId, method) {
+			return r, true
+		}
+	}
+	return fp.defaultRule, true
+}
+
+// apply disturbs an RPC received by serverId from peerId, returning an error
+// if it is dropped. It returns straight away when the policy is disabled.
+func (fp *FaultPolicy) apply(logger *log.Logger, serverId int, peerId int, method string) error {
+	if fp == nil {
+		return nil
+	}
+	r, ok := fp.rule(peerId, method)
+	if !ok {
+		return nil
+	}
+
+	f := rand.Float64()
+	// 模拟 rpc 请求失败
+	if f < r.DropRate {
+		logger.Printf("[%d] drop %s from %d", serverId, method, peerId)
+		time.Sleep(r.DropDelay)
+		return fmt.Errorf("RPC failed")
+	}
+	// 模拟网络延迟
+	if f < r.DropRate+r.DelayRate {
+		logger.Printf("[%d] delay %s from %d", serverId, method, peerId)
+		time.Sleep(randDuration(r.DelayMin, r.DelayMax))
+	} else {
+		time.Sleep(randDuration(r.LatencyMin, r.LatencyMax))
+	}
+	return nil
+}
+
+func randDuration(min, max time.Duration) time.Duration {
+	if max <= min {
+		return min
+	}
+	return min + time.Duration(rand.Int63n(int64(max-min)))
+}
@@ -0,0 +1,50 @@
+package raft
+
+import (
+	"log"
+	"testing"
+	"time"
+)
+
+func TestFaultPolicyRules(t *testing.T) {
+	fp := NewFaultPolicy()
+	fp.AddRule(FaultRule{Peer: 2, Method: "AppendEntries", DropRate: 1})
+
+	// Disabled, even the rule dropping everything lets RPCs straight through.
+	start := time.Now()
+	for i := 0; i < 100; i++ {
+		if err := fp.apply(log.Default(), 0, 2, "AppendEntries"); err != nil {
+			t.Fatalf("disabled policy dropped an RPC: %v", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("disabled policy took %v for 100 RPCs", elapsed)
+	}
+
+	fp.SetEnabled(true)
+	fp.SetDefault(FaultRule{})
+	if err := fp.apply(log.Default(), 0, 2, "AppendEntries"); err == nil {
+		t.Errorf("AppendEntries from 2 was not dropped")
+	}
+	if err := fp.apply(log.Default(), 0, 2, "RequestVote"); err != nil {
+		t.Errorf("RequestVote from 2 was dropped: %v", err)
+	}
+	if err := fp.apply(log.Default(), 0, 1, "AppendEntries"); err != nil {
+		t.Errorf("AppendEntries from 1 was dropped: %v", err)
+	}
+
+	fp.SetDefault(FaultRule{LatencyMin: 20 * time.Millisecond, LatencyMax: 30 * time.Millisecond})
+	start = time.Now()
+	if err := fp.apply(log.Default(), 0, 1, "AppendEntries"); err != nil {
+		t.Errorf("AppendEntries from 1 was dropped: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Errorf("RPC delayed by %v, want at least 20ms", elapsed)
+	}
+
+	fp.ClearRules()
+	fp.SetDefault(FaultRule{})
+	if err := fp.apply(log.Default(), 0, 2, "AppendEntries"); err != nil {
+		t.Errorf("AppendEntries from 2 was dropped after ClearRules: %v", err)
+	}
+}
@@ -0,0 +1,340 @@
+package raft
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	walFileName = "wal"
+
+	// walCompactMinSize is the size below which the WAL is never compacted.
+	walCompactMinSize = 1 << 20
+
+	// walRecordHeaderSize covers the payload length and its CRC-32 checksum.
+	walRecordHeaderSize = 8
+
+	// A record's payload starts with its kind, followed by the key length, the
+	// key and, for walRecordSet, the value.
+	walRecordSet    = 1
+	walRecordDelete = 2
+)
+
+var errTornRecord = errors.New("torn WAL record")
+
+// ErrCorruptWAL is returned by NewFileStorage when a WAL record before the
+// last one is damaged. Only the last record can be torn by a crash, so the
+// records after a damaged one are not dropped silently.
+var ErrCorruptWAL = errors.New("FileStorage: corrupt WAL record")
+
+// FileStorage is a Storage that keeps its data in memory and makes every Set
+// and Delete durable by appending it to a write-ahead log in a data directory,
+// synced to disk before the call returns. NewFileStorage replays the log,
+// dropping a torn record left at its tail by a crash. Once most of the log
+// consists of overwritten or deleted values it is compacted into a fresh file
+// holding only the current ones.
+//
+// After a failed write the state of the file is unknown, so every later call
+// returns the same error.
+type FileStorage struct {
+	mu     sync.Mutex
+	m      map[string][]byte
+	dir    string
+	file   *os.File
+	err    error
+	logger *log.Logger
+
+	// size is the length of the WAL file; liveSize is the space the current
+	// values would take in a compacted one.
+	size     int64
+	liveSize int64
+}
+
+// NewFileStorage opens the WAL in dir, creating dir if needed, and recovers
+// the data persisted there.
+func NewFileStorage(dir string) (*FileStorage, error) {
+	return NewFileStorageWithLogger(dir, nil)
+}
+
+// NewFileStorageWithLogger is NewFileStorage with the logger that receives
+// recovery notices, such as a torn record being dropped. Nil means the
+// standard logger.
+func NewFileStorageWithLogger(dir string, logger *log.Logger) (*FileStorage, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	if logger == nil {
+		logger = log.Default()
+	}
+	fs := &FileStorage{
+		m:      make(map[string][]byte),
+		dir:    dir,
+		logger: logger,
+	}
+	f, err := os.OpenFile(filepath.Join(dir, walFileName), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	fs.file = f
+	// Make sure a newly created WAL is still there after a crash.
+	if err := syncDir(dir); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	if err := fs.recover(); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return fs, nil
+}
+
+// recover replays the WAL into fs.m and truncates any torn record at its tail.
+func (fs *FileStorage) recover() error {
+	info, err := fs.file.Stat()
+	if err != nil {
+		return err
+	}
+	fileSize := info.Size()
+	r := bufio.NewReader(fs.file)
+	var offset int64
+	for {
+		kind, key, value, n, err := readWALRecord(r, fileSize-offset)
+		if err == io.EOF {
+			break
+		}
+		if err == errTornRecord && offset+n < fileSize {
+			return fmt.Errorf("%w at offset %d in %s", ErrCorruptWAL, offset, fs.dir)
+		}
+		if err == errTornRecord {
+			fs.logger.Printf("FileStorage: truncating torn WAL record at offset %d in %s", offset, fs.dir)
+			if err := fs.file.Truncate(offset); err != nil {
+				return err
+			}
+			if err := fs.file.Sync(); err != nil {
+				return err
+			}
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if kind == walRecordDelete {
+			fs.deleteLocked(key)
+		} else {
+			fs.setLocked(key, value)
+		}
+		offset += n
+	}
+	fs.size = offset
+	_, err = fs.file.Seek(offset, io.SeekStart)
+	return err
+}
+
+// readWALRecord reads one record from r, which has remaining bytes left,
+// returning its kind, key, value and encoded size. A record that runs past
+// the end or fails its checksum yields errTornRecord, along with the size it
+// takes up.
+func readWALRecord(r io.Reader, remaining int64) (byte, string, []byte, int64, error) {
+	var header [walRecordHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if err == io.EOF {
+			return 0, "", nil, 0, io.EOF
+		}
+		if err == io.ErrUnexpectedEOF {
+			return 0, "", nil, remaining, errTornRecord
+		}
+		return 0, "", nil, 0, err
+	}
+	length := binary.LittleEndian.Uint32(header[0:4])
+	checksum := binary.LittleEndian.Uint32(header[4:8])
+	size := int64(walRecordHeaderSize) + int64(length)
+	if size > remaining {
+		// Don't trust the length with an allocation before it is checked.
+		return 0, "", nil, remaining, errTornRecord
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return 0, "", nil, remaining, errTornRecord
+		}
+		return 0, "", nil, 0, err
+	}
+	if crc32.ChecksumIEEE(payload) != checksum || length < 5 {
+		return 0, "", nil, size, errTornRecord
+	}
+	kind := payload[0]
+	keyLen := binary.LittleEndian.Uint32(payload[1:5])
+	if uint64(keyLen) > uint64(length-5) {
+		return 0, "", nil, size, errTornRecord
+	}
+	key := string(payload[5 : 5+keyLen])
+	value := payload[5+keyLen:]
+	return kind, key, value, size, nil
+}
+
+func encodeWALRecord(kind byte, key string, value []byte) []byte {
+	payloadLen := 5 + len(key) + len(value)
+	buf := make([]byte, walRecordHeaderSize+payloadLen)
+	payload := buf[walRecordHeaderSize:]
+	payload[0] = kind
+	binary.LittleEndian.PutUint32(payload[1:5], uint32(len(key)))
+	copy(payload[5:], key)
+	copy(payload[5+len(key):], value)
+	binary.LittleEndian.PutUint32(buf[0:4], uint32(payloadLen))
+	binary.LittleEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(payload))
+	return buf
+}
+
+func walRecordSize(key string, value []byte) int64 {
+	return int64(walRecordHeaderSize + 5 + len(key) + len(value))
+}
+
+func (fs *FileStorage) Get(key string) ([]byte, bool, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.err != nil {
+		return nil, false, fs.err
+	}
+	v, found := fs.m[key]
+	return v, found, nil
+}
+
+func (fs *FileStorage) Set(key string, value []byte) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.err != nil {
+		return fs.err
+	}
+	if err := fs.append(walRecordSet, key, value); err != nil {
+		fs.err = err
+		return err
+	}
+	fs.setLocked(key, append([]byte(nil), value...))
+	return fs.maybeCompact()
+}
+
+func (fs *FileStorage) Delete(key string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.err != nil {
+		return fs.err
+	}
+	if _, found := fs.m[key]; !found {
+		return nil
+	}
+	if err := fs.append(walRecordDelete, key, nil); err != nil {
+		fs.err = err
+		return err
+	}
+	fs.deleteLocked(key)
+	return fs.maybeCompact()
+}
+
+func (fs *FileStorage) HasData() (bool, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return len(fs.m) > 0, fs.err
+}
+
+// Close closes the WAL file. The FileStorage must not be used afterwards.
+func (fs *FileStorage) Close() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.file.Close()
+}
+
+func (fs *FileStorage) setLocked(key string, value []byte) {
+	if old, found := fs.m[key]; found {
+		fs.liveSize -= walRecordSize(key, old)
+	}
+	fs.m[key] = value
+	fs.liveSize += walRecordSize(key, value)
+}
+
+func (fs *FileStorage) deleteLocked(key string) {
+	if old, found := fs.m[key]; found {
+		fs.liveSize -= walRecordSize(key, old)
+		delete(fs.m, key)
+	}
+}
+
+func (fs *FileStorage) maybeCompact() error {
+	if fs.size > walCompactMinSize && fs.size > 2*fs.liveSize {
+		if err := fs.compact(); err != nil {
+			fs.err = fmt.Errorf("FileStorage: compact WAL: %w", err)
+			return fs.err
+		}
+	}
+	return nil
+}
+
+// append writes a record for key to the end of the WAL and syncs it.
+func (fs *FileStorage) append(kind byte, key string, value []byte) error {
+	rec := encodeWALRecord(kind, key, value)
+	if _, err := fs.file.Write(rec); err != nil {
+		return fmt.Errorf("FileStorage: write WAL: %w", err)
+	}
+	if err := fs.file.Sync(); err != nil {
+		return fmt.Errorf("FileStorage: sync WAL: %w", err)
+	}
+	fs.size += int64(len(rec))
+	return nil
+}
+
+// compact rewrites the WAL with only the current values, replacing the old
+// file atomically by renaming the new one over it.
+func (fs *FileStorage) compact() error {
+	tmpPath := filepath.Join(fs.dir, walFileName+".tmp")
+	tmp, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	var size int64
+	for key, value := range fs.m {
+		rec := encodeWALRecord(walRecordSet, key, value)
+		if _, err := w.Write(rec); err != nil {
+			_ = tmp.Close()
+			return err
+		}
+		size += int64(len(rec))
+	}
+	if err := w.Flush(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := os.Rename(tmpPath, filepath.Join(fs.dir, walFileName)); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := syncDir(fs.dir); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	_ = fs.file.Close()
+	fs.file = tmp
+	fs.size = size
+	_, err = fs.file.Seek(size, io.SeekStart)
+	return err
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,232 @@
+package raft
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileStorageRecoversAfterReopen(t *testing.T) {
+	dir := t.TempDir()
+	fs, err := NewFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hasData, err := fs.HasData(); hasData || err != nil {
+		t.Fatalf("got HasData()=%v, %v on new storage", hasData, err)
+	}
+	if err := fs.Set("currentTerm", []byte{1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Set("votedFor", []byte{2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Set("currentTerm", []byte{3}); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	fs, err = NewFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	if v, found, _ := fs.Get("currentTerm"); !found || !bytes.Equal(v, []byte{3}) {
+		t.Errorf("got currentTerm=%v, found=%v, want [3]", v, found)
+	}
+	if v, found, _ := fs.Get("votedFor"); !found || !bytes.Equal(v, []byte{2}) {
+		t.Errorf("got votedFor=%v, found=%v, want [2]", v, found)
+	}
+}
+
+func TestFileStorageTruncatesTornTail(t *testing.T) {
+	dir := t.TempDir()
+	fs, err := NewFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Set("a", []byte("first")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Set("b", []byte("second")); err != nil {
+		t.Fatal(err)
+	}
+	fs.Close()
+
+	// Simulate a crash in the middle of writing the last record.
+	path := filepath.Join(dir, walFileName)
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(path, info.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+
+	var logged bytes.Buffer
+	fs, err = NewFileStorageWithLogger(dir, log.New(&logged, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(logged.Bytes(), []byte("torn WAL record")) {
+		t.Errorf("torn record was not logged, got %q", logged.String())
+	}
+	if v, found, _ := fs.Get("a"); !found || string(v) != "first" {
+		t.Errorf("got a=%q, found=%v, want %q", v, found, "first")
+	}
+	if _, found, _ := fs.Get("b"); found {
+		t.Errorf("torn record for b was recovered")
+	}
+
+	// The torn bytes are gone, so new records are readable after reopening.
+	if err := fs.Set("c", []byte("third")); err != nil {
+		t.Fatal(err)
+	}
+	fs.Close()
+	fs, err = NewFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	if v, found, _ := fs.Get("c"); !found || string(v) != "third" {
+		t.Errorf("got c=%q, found=%v, want %q", v, found, "third")
+	}
+}
+
+func TestFileStorageRejectsCorruptRecord(t *testing.T) {
+	dir := t.TempDir()
+	fs, err := NewFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Set("a", []byte("first")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Set("b", []byte("second")); err != nil {
+		t.Fatal(err)
+	}
+	fs.Close()
+
+	// Flip a byte in the payload of the first record, which is not the last.
+	path := filepath.Join(dir, walFileName)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[walRecordHeaderSize+6] ^= 0xff
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewFileStorage(dir); !errors.Is(err, ErrCorruptWAL) {
+		t.Errorf("got err %v, want %v", err, ErrCorruptWAL)
+	}
+	if info, err := os.Stat(path); err != nil || info.Size() != int64(len(data)) {
+		t.Errorf("WAL was truncated after a corrupt record")
+	}
+}
+
+func TestFileStorageTruncatesOversizedTail(t *testing.T) {
+	dir := t.TempDir()
+	fs, err := NewFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Set("a", []byte("first")); err != nil {
+		t.Fatal(err)
+	}
+	fs.Close()
+
+	// A header whose length runs far past the end of the file.
+	path := filepath.Join(dir, walFileName)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0})
+	f.Close()
+
+	fs, err = NewFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	if v, found, _ := fs.Get("a"); !found || string(v) != "first" {
+		t.Errorf("got a=%q, found=%v, want %q", v, found, "first")
+	}
+}
+
+func TestFileStorageCompaction(t *testing.T) {
+	dir := t.TempDir()
+	fs, err := NewFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value := make([]byte, 64<<10)
+	for i := 0; i < 64; i++ {
+		value[0] = byte(i)
+		if err := fs.Set("log", value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fs.Close()
+
+	info, err := os.Stat(filepath.Join(dir, walFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() > 2*walCompactMinSize {
+		t.Errorf("WAL is %d bytes, want it compacted", info.Size())
+	}
+	fs, err = NewFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	if v, found, _ := fs.Get("log"); !found || v[0] != 63 || len(v) != len(value) {
+		t.Errorf("got a log value of %d bytes starting with %d after compaction", len(v), v[0])
+	}
+}
+
+func TestConsensusModuleRestoresFromFileStorage(t *testing.T) {
+	dir := t.TempDir()
+	fs, err := NewFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cm := &ConsensusModule{storage: fs, currentTerm: 7, votedFor: 2, lastIncludedIndex: -1, lastIncludedTerm: -1}
+	if err := cm.restore(); err != nil {
+		t.Fatal(err)
+	}
+	if err := cm.persistHardState(); err != nil {
+		t.Fatal(err)
+	}
+	if err := cm.appendLog(LogEntry{Command: 41, Term: 6}, LogEntry{Command: 42, Term: 7}); err != nil {
+		t.Fatal(err)
+	}
+	if err := cm.truncateLog(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := cm.appendLog(LogEntry{Command: 43, Term: 7}); err != nil {
+		t.Fatal(err)
+	}
+	fs.Close()
+
+	fs, err = NewFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	restored := &ConsensusModule{storage: fs, lastIncludedIndex: -1, lastIncludedTerm: -1}
+	if err := restored.restore(); err != nil {
+		t.Fatal(err)
+	}
+	if restored.currentTerm != 7 || restored.votedFor != 2 || len(restored.log) != 2 || restored.log[1].Command != 43 {
+		t.Errorf("got term=%d votedFor=%d log=%v", restored.currentTerm, restored.votedFor, restored.log)
+	}
+}
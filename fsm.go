@@ -0,0 +1,88 @@
+package raft
+
+import (
+	"bytes"
+	"errors"
+	"io"
+)
+
+// FSM is the replicated state machine a ConsensusModule drives. Apply and
+// Restore are called from a single goroutine, in log order.
+type FSM interface {
+	// Apply applies a committed entry. Its result is returned by the
+	// ProposeAndWait call that proposed the entry, if any.
+	Apply(entry CommitEntry) interface{}
+	// Snapshot serializes the state reached by the entries applied so far.
+	Snapshot() ([]byte, error)
+	// Restore replaces the state with the one serialized in snapshot.
+	Restore(snapshot io.Reader) error
+}
+
+// snapshotRestorer is implemented by an FSM that wants to know which entry a
+// restored snapshot ends at; the ConsensusModule then calls restoreAt
+// instead of Restore.
+type snapshotRestorer interface {
+	restoreAt(entry CommitEntry) error
+}
+
+var errChannelSnapshot = errors.New("raft: a commit channel cannot take snapshots; call Snapshot with the application's state instead")
+
+// channelFSM sends committed entries and snapshots on a channel, for
+// applications that consume CommitEntry values themselves.
+type channelFSM struct {
+	commitChan chan<- CommitEntry
+}
+
+// NewChannelFSM returns an FSM that sends every committed entry, and every
+// snapshot to restore, on commitChan. Apply results are always nil, and the
+// application takes snapshots by calling ConsensusModule.Snapshot.
+func NewChannelFSM(commitChan chan<- CommitEntry) FSM {
+	return &channelFSM{commitChan: commitChan}
+}
+
+func (f *channelFSM) Apply(entry CommitEntry) interface{} {
+	f.commitChan <- entry
+	return nil
+}
+
+func (f *channelFSM) Snapshot() ([]byte, error) {
+	return nil, errChannelSnapshot
+}
+
+func (f *channelFSM) Restore(snapshot io.Reader) error {
+	data, err := io.ReadAll(snapshot)
+	if err != nil {
+		return err
+	}
+	return f.restoreAt(CommitEntry{Index: -1, Term: -1, Snapshot: data})
+}
+
+func (f *channelFSM) restoreAt(entry CommitEntry) error {
+	f.commitChan <- entry
+	return nil
+}
+
+// restoreFSM hands the snapshot in entry to the FSM.
+func (cm *ConsensusModule) restoreFSM(entry CommitEntry) error {
+	if r, ok := cm.fsm.(snapshotRestorer); ok {
+		return r.restoreAt(entry)
+	}
+	return cm.fsm.Restore(bytes.NewReader(entry.Snapshot))
+}
+
+// TakeSnapshot asks the FSM for a snapshot of the entries applied so far and
+// compacts the log up to them, as Snapshot does.
+func (cm *ConsensusModule) TakeSnapshot() error {
+	cm.applyMu.Lock()
+	index := cm.fsmApplied
+	var data []byte
+	var err error
+	if index >= 0 {
+		data, err = cm.fsm.Snapshot()
+	}
+	cm.applyMu.Unlock()
+	if err != nil || index < 0 {
+		return err
+	}
+	return cm.Snapshot(index, data)
+}
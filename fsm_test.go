@@ -0,0 +1,129 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+// counterFSM adds up the integers it applies.
+type counterFSM struct {
+	mu  sync.Mutex
+	sum int
+}
+
+func (f *counterFSM) Apply(entry CommitEntry) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if entry.IsData {
+		// Commands submitted as data count as 1.
+		f.sum++
+	} else {
+		f.sum += entry.Command.(int)
+	}
+	return f.sum
+}
+
+func (f *counterFSM) Snapshot() ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var data bytes.Buffer
+	err := gob.NewEncoder(&data).Encode(f.sum)
+	return data.Bytes(), err
+}
+
+func (f *counterFSM) Restore(snapshot io.Reader) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return gob.NewDecoder(snapshot).Decode(&f.sum)
+}
+
+func (f *counterFSM) get() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.sum
+}
+
+func TestFSMApplyResultsAndRestore(t *testing.T) {
+	fsms := []FSM{&counterFSM{}, &counterFSM{}, &counterFSM{}}
+	cms, stop := startInmemClusterWithFSMs(t, NewInmemNetwork(), DefaultConfig(), fsms)
+	defer stop()
+
+	leaderId := waitForLeader(cms)
+	if leaderId < 0 {
+		t.Fatalf("no leader elected")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, want := range []struct{ add, sum int }{{5, 5}, {3, 8}} {
+		_, result, err := cms[leaderId].ProposeAndWait(ctx, want.add)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result != want.sum {
+			t.Errorf("adding %d returned %v, want %d", want.add, result, want.sum)
+		}
+	}
+
+	if err := cms[leaderId].TakeSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+	cms[leaderId].Stop()
+
+	// A module restarted from the same storage restores the snapshot into its
+	// new FSM.
+	restored := &counterFSM{}
+	cm, err := NewConsensusModule(leaderId, []int{}, DefaultConfig(), nil, make(chan interface{}), cms[leaderId].storage, restored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cm.Stop()
+	for i := 0; i < 50 && restored.get() != 8; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := restored.get(); got != 8 {
+		t.Errorf("restored sum is %d, want 8", got)
+	}
+}
+
+func TestChannelFSMTakeSnapshotFails(t *testing.T) {
+	if _, err := NewChannelFSM(make(chan CommitEntry)).Snapshot(); err == nil {
+		t.Errorf("channel FSM took a snapshot")
+	}
+}
+
+// Only command entries reach the FSM, and only configuration entries change
+// the configuration, whatever their commands look like.
+func TestEntryTypes(t *testing.T) {
+	commits := make(chan CommitEntry, 4)
+	cm := &ConsensusModule{fsm: NewChannelFSM(commits), lastIncludedIndex: -1, lastIncludedTerm: -1}
+	configuration := Configuration{Voters: []int{0, 1, 2}}
+	cm.log = []LogEntry{
+		{Term: 1, Type: EntryNoop},
+		{Term: 1, Type: EntryConfiguration, Command: ConfigurationChange{configuration}},
+		{Term: 1, Type: EntryCommand, Command: ConfigurationChange{Configuration{Voters: []int{5}}}},
+		{Term: 1, Type: EntryCommand, Command: 7},
+	}
+
+	if got, index := cm.configurationAt(3); index != 1 || !sameIds(got.Voters, configuration.Voters) {
+		t.Errorf("configurationAt(3) = %+v at %d, want %+v at 1", got, index, configuration)
+	}
+	for i, entry := range cm.log {
+		cm.applyEntry(CommitEntry{Index: i, Term: entry.Term, Type: entry.Type, Command: entry.Command})
+	}
+	close(commits)
+	var indices []int
+	for c := range commits {
+		if c.Type != EntryCommand {
+			t.Errorf("FSM got an entry of type %v", c.Type)
+		}
+		indices = append(indices, c.Index)
+	}
+	if len(indices) != 2 || indices[0] != 2 || indices[1] != 3 {
+		t.Errorf("FSM got entries at %v, want [2 3]", indices)
+	}
+}
@@ -0,0 +1,225 @@
+package kv
+
+import (
+	"context"
+	"net/rpc"
+	"sync"
+	"time"
+
+	"raft"
+)
+
+// SessionTimeout is how long a client session lasts without operations. Use
+// it to wrap the Store with raft.NewSessionFSM.
+const SessionTimeout = time.Minute
+
+// ErrSessionExpired is returned for an operation whose session the cluster
+// no longer knows, so it cannot tell whether the operation was applied. The
+// Client opens a new session for the next operation.
+var ErrSessionExpired = raft.ErrSessionExpired
+
+// ErrStaleSequence is returned for an operation the cluster refused as older
+// than one it already applied in the session.
+var ErrStaleSequence = raft.ErrStaleSequence
+
+// attemptTimeout bounds a single RPC to one server. It is longer than the
+// time a server spends on an operation, so only unreachable servers time out.
+const attemptTimeout = 2 * DefaultTimeout
+
+// Client talks to the servers of a cluster over net/rpc, sending each
+// operation to the server it believes is the leader and moving on to the
+// next one when that server fails or is not the leader.
+//
+// Operations run in a client session, opened on the first one, so retrying
+// an operation never applies it twice. A Client runs one operation at a time.
+type Client struct {
+	// opMu is held for the duration of an operation.
+	opMu sync.Mutex
+	// clientID and seq identify the session and the last operation in it;
+	// clientID is -1 while there is no session.
+	clientID int
+	seq      int
+
+	mu      sync.Mutex
+	addrs   []string
+	clients []*rpc.Client
+	leader  int
+}
+
+func NewClient(addrs []string) *Client {
+	return &Client{
+		clientID: -1,
+		addrs:    addrs,
+		clients:  make([]*rpc.Client, len(addrs)),
+	}
+}
+
+func (c *Client) Get(ctx context.Context, key string) (string, bool, error) {
+	var reply *GetReply
+	err := c.do(ctx, "KV.Get", func(session SessionArgs) (interface{}, statusReply) {
+		reply = new(GetReply)
+		return GetArgs{SessionArgs: session, Key: key}, reply
+	})
+	if err != nil {
+		return "", false, err
+	}
+	return reply.Value, reply.Found, nil
+}
+
+func (c *Client) Put(ctx context.Context, key, value string) error {
+	var reply *PutReply
+	return c.do(ctx, "KV.Put", func(session SessionArgs) (interface{}, statusReply) {
+		reply = new(PutReply)
+		return PutArgs{SessionArgs: session, Key: key, Value: value}, reply
+	})
+}
+
+func (c *Client) Delete(ctx context.Context, key string) error {
+	var reply *DeleteReply
+	return c.do(ctx, "KV.Delete", func(session SessionArgs) (interface{}, statusReply) {
+		reply = new(DeleteReply)
+		return DeleteArgs{SessionArgs: session, Key: key}, reply
+	})
+}
+
+// CompareAndSwap sets key to value if it currently holds old, reporting
+// whether it did.
+func (c *Client) CompareAndSwap(ctx context.Context, key, old, value string) (bool, error) {
+	var reply *CompareAndSwapReply
+	err := c.do(ctx, "KV.CompareAndSwap", func(session SessionArgs) (interface{}, statusReply) {
+		reply = new(CompareAndSwapReply)
+		return CompareAndSwapArgs{SessionArgs: session, Key: key, Old: old, Value: value}, reply
+	})
+	if err != nil {
+		return false, err
+	}
+	return reply.Swapped, nil
+}
+
+// do runs the next operation of the session, opening one first if needed.
+// request returns the arguments and a fresh reply for the operation.
+func (c *Client) do(ctx context.Context, method string, request func(SessionArgs) (interface{}, statusReply)) error {
+	c.opMu.Lock()
+	defer c.opMu.Unlock()
+
+	if c.clientID < 0 {
+		var reply *RegisterReply
+		err := c.call(ctx, "KV.Register", func() (interface{}, statusReply) {
+			reply = new(RegisterReply)
+			return RegisterArgs{}, reply
+		})
+		if err != nil {
+			return err
+		}
+		c.clientID = reply.ClientID
+		c.seq = 0
+	}
+
+	c.seq++
+	session := SessionArgs{ClientID: c.clientID, Seq: c.seq}
+	err := c.call(ctx, method, func() (interface{}, statusReply) { return request(session) })
+	if err == ErrSessionExpired {
+		c.clientID = -1
+	}
+	return err
+}
+
+// Close closes the connections to the servers.
+func (c *Client) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, client := range c.clients {
+		if client != nil {
+			_ = client.Close()
+			c.clients[i] = nil
+		}
+	}
+}
+
+// call tries the servers in turn until one that is the leader answers, and
+// sends the operation to the same server again when it asks for a retry.
+// Every attempt calls request for its arguments and a fresh reply, as an
+// abandoned attempt may still fill in its own.
+func (c *Client) call(ctx context.Context, method string, request func() (interface{}, statusReply)) error {
+	c.mu.Lock()
+	server := c.leader
+	c.mu.Unlock()
+
+	for tried := 0; ; tried++ {
+		if tried > 0 && tried%len(c.addrs) == 0 {
+			// No server took the operation; give the cluster time to elect a
+			// leader before going round again.
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(50 * time.Millisecond):
+			}
+		}
+
+		args, reply := request()
+		err := c.attempt(ctx, server, method, args, reply)
+		status := reply.status()
+		if err == nil && !status.WrongLeader && !status.Retry {
+			c.mu.Lock()
+			c.leader = server
+			c.mu.Unlock()
+			switch {
+			case status.SessionExpired:
+				return ErrSessionExpired
+			case status.StaleSequence:
+				return ErrStaleSequence
+			}
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil || status.WrongLeader {
+			server = (server + 1) % len(c.addrs)
+		}
+	}
+}
+
+// attempt sends one RPC to server, waiting at most attemptTimeout.
+func (c *Client) attempt(ctx context.Context, server int, method string, args interface{}, reply interface{}) error {
+	client, err := c.client(server)
+	if err != nil {
+		return err
+	}
+	timer := time.NewTimer(attemptTimeout)
+	defer timer.Stop()
+	call := client.Go(method, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		if call.Error == rpc.ErrShutdown {
+			c.dropClient(server, client)
+		}
+		return call.Error
+	case <-timer.C:
+		return context.DeadlineExceeded
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *Client) client(server int) (*rpc.Client, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.clients[server] == nil {
+		client, err := rpc.Dial("tcp", c.addrs[server])
+		if err != nil {
+			return nil, err
+		}
+		c.clients[server] = client
+	}
+	return c.clients[server], nil
+}
+
+func (c *Client) dropClient(server int, client *rpc.Client) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.clients[server] == client {
+		_ = client.Close()
+		c.clients[server] = nil
+	}
+}
@@ -0,0 +1,210 @@
+package kv
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"raft"
+)
+
+// startCluster starts n replicated stores in a raft Harness, each serving the
+// KV RPCs on its own listener, and returns their addresses.
+func startCluster(t *testing.T, n int) (*raft.Harness, []string) {
+	fsms := make([]raft.FSM, n)
+	for i := range fsms {
+		fsms[i] = raft.NewSessionFSM(NewStore(), SessionTimeout)
+	}
+	h := raft.NewHarnessWithFSMs(t, raft.DefaultConfig(), fsms)
+	t.Cleanup(h.Shutdown)
+
+	addrs := make([]string, n)
+	for i := 0; i < n; i++ {
+		server, err := NewRPCServer(NewService(h.Server(i).ConsensusModule()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { l.Close() })
+		go server.Accept(l)
+		addrs[i] = l.Addr().String()
+	}
+	return h, addrs
+}
+
+func newClient(t *testing.T, addrs []string) *Client {
+	client := NewClient(addrs)
+	t.Cleanup(client.Close)
+	return client
+}
+
+func TestOperations(t *testing.T) {
+	_, addrs := startCluster(t, 3)
+	client := newClient(t, addrs)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if _, found, err := client.Get(ctx, "a"); err != nil || found {
+		t.Fatalf("Get of a missing key: found=%v, err=%v", found, err)
+	}
+	if err := client.Put(ctx, "a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if value, found, err := client.Get(ctx, "a"); err != nil || !found || value != "1" {
+		t.Fatalf("Get(a) = %q, %v, %v; want 1", value, found, err)
+	}
+	if swapped, err := client.CompareAndSwap(ctx, "a", "2", "3"); err != nil || swapped {
+		t.Errorf("CompareAndSwap(a, 2, 3) = %v, %v; want no swap", swapped, err)
+	}
+	if swapped, err := client.CompareAndSwap(ctx, "a", "1", "3"); err != nil || !swapped {
+		t.Errorf("CompareAndSwap(a, 1, 3) = %v, %v; want a swap", swapped, err)
+	}
+	if value, _, err := client.Get(ctx, "a"); err != nil || value != "3" {
+		t.Errorf("Get(a) = %q, %v; want 3", value, err)
+	}
+	if err := client.Delete(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, found, err := client.Get(ctx, "a"); err != nil || found {
+		t.Errorf("Get of a deleted key: found=%v, err=%v", found, err)
+	}
+}
+
+// Clients increment a counter with read-then-CompareAndSwap while the leader
+// is repeatedly partitioned away. Linearizability means no two increments
+// from the same value both succeed, no client reads a value older than one
+// it saw before, and, as sessions keep retries from applying twice, the
+// counter ends up at exactly the number of successful swaps.
+func TestLinearizableUnderPartitions(t *testing.T) {
+	h, addrs := startCluster(t, 3)
+	client := newClient(t, addrs)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := client.Put(ctx, "counter", "0"); err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	swappedTo := make(map[int]int)
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for c := 0; c < 3; c++ {
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			client := newClient(t, addrs)
+			last := 0
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				value, _, err := client.Get(ctx, "counter")
+				if err != nil {
+					continue
+				}
+				v, _ := strconv.Atoi(value)
+				if v < last {
+					t.Errorf("client %d read %d after %d", c, v, last)
+				}
+				last = v
+				swapped, err := client.CompareAndSwap(ctx, "counter", value, strconv.Itoa(v+1))
+				if err == nil && swapped {
+					mu.Lock()
+					if other, ok := swappedTo[v+1]; ok {
+						t.Errorf("clients %d and %d both incremented %d", other, c, v)
+					}
+					swappedTo[v+1] = c
+					mu.Unlock()
+					last = v + 1
+				}
+			}
+		}(c)
+	}
+
+	for i := 0; i < 3; i++ {
+		time.Sleep(500 * time.Millisecond)
+		leaderId, _ := h.CheckSingleLeader()
+		h.DisconnectPeer(leaderId)
+		time.Sleep(1000 * time.Millisecond)
+		h.ReconnectPeer(leaderId)
+	}
+	close(stop)
+	wg.Wait()
+
+	value, _, err := client.Get(ctx, "counter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	final, _ := strconv.Atoi(value)
+	if final != len(swappedTo) {
+		t.Errorf("counter is %d after %d successful increments", final, len(swappedTo))
+	}
+	if len(swappedTo) == 0 {
+		t.Errorf("no increment succeeded")
+	}
+}
+
+// failingRaft is a Raft whose operations all fail with err, as a module that
+// failed with failed.
+type failingRaft struct {
+	err    error
+	failed error
+}
+
+func (f failingRaft) ProposeAndWait(ctx context.Context, command interface{}) (int, interface{}, error) {
+	return -1, nil, f.err
+}
+
+func (f failingRaft) RegisterSession(ctx context.Context) (int, error) {
+	return -1, f.err
+}
+
+func (f failingRaft) ProposeInSession(ctx context.Context, clientID int, seq int, command interface{}) (interface{}, error) {
+	return nil, f.err
+}
+
+func (f failingRaft) Err() error {
+	return f.failed
+}
+
+func TestRPCErrorStatus(t *testing.T) {
+	storageErr := errors.New("disk on fire")
+	tests := []struct {
+		raft failingRaft
+		want ReplyStatus
+	}{
+		{failingRaft{err: raft.ErrNotLeader}, ReplyStatus{WrongLeader: true}},
+		{failingRaft{err: raft.ErrStopped}, ReplyStatus{WrongLeader: true}},
+		{failingRaft{err: raft.ErrLeadershipLost}, ReplyStatus{WrongLeader: true}},
+		{failingRaft{err: storageErr, failed: storageErr}, ReplyStatus{WrongLeader: true}},
+		{failingRaft{err: raft.ErrProposalDropped}, ReplyStatus{Retry: true}},
+		{failingRaft{err: raft.ErrProposalUnknown}, ReplyStatus{Retry: true}},
+		{failingRaft{err: context.DeadlineExceeded}, ReplyStatus{Retry: true}},
+		{failingRaft{err: raft.ErrSessionExpired}, ReplyStatus{SessionExpired: true}},
+		{failingRaft{err: raft.ErrStaleSequence}, ReplyStatus{StaleSequence: true}},
+	}
+	for _, tt := range tests {
+		r := &rpcService{NewService(tt.raft)}
+		var reply PutReply
+		if err := r.Put(PutArgs{Key: "k", Value: "v"}, &reply); err != nil {
+			t.Errorf("%v: got err %v", tt.raft.err, err)
+		}
+		if reply.ReplyStatus != tt.want {
+			t.Errorf("%v: got status %+v, want %+v", tt.raft.err, reply.ReplyStatus, tt.want)
+		}
+	}
+
+	r := &rpcService{NewService(failingRaft{err: storageErr})}
+	if err := r.Put(PutArgs{Key: "k", Value: "v"}, &PutReply{}); err != storageErr {
+		t.Errorf("got err %v, want %v", err, storageErr)
+	}
+}
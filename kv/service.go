@@ -0,0 +1,226 @@
+package kv
+
+import (
+	"context"
+	"errors"
+	"net/rpc"
+	"time"
+
+	"raft"
+)
+
+// DefaultTimeout bounds how long the Service waits for an operation it
+// serves over RPC to be applied.
+const DefaultTimeout = time.Second
+
+// Raft is the part of a ConsensusModule the Service uses.
+type Raft interface {
+	ProposeAndWait(ctx context.Context, command interface{}) (int, interface{}, error)
+	RegisterSession(ctx context.Context) (int, error)
+	ProposeInSession(ctx context.Context, clientID int, seq int, command interface{}) (interface{}, error)
+	Err() error
+}
+
+// Service runs key-value operations against the Store the Raft applies its
+// log to. Operations fail with raft.ErrNotLeader unless the Raft is the
+// leader. Operations received over RPC run in client sessions, which need the
+// Store to be wrapped by raft.NewSessionFSM.
+type Service struct {
+	raft    Raft
+	timeout time.Duration
+}
+
+func NewService(r Raft) *Service {
+	return &Service{raft: r, timeout: DefaultTimeout}
+}
+
+func (s *Service) Get(ctx context.Context, key string) (string, bool, error) {
+	res, err := s.propose(ctx, Op{Kind: OpGet, Key: key})
+	return res.Value, res.Found, err
+}
+
+func (s *Service) Put(ctx context.Context, key, value string) error {
+	_, err := s.propose(ctx, Op{Kind: OpPut, Key: key, Value: value})
+	return err
+}
+
+func (s *Service) Delete(ctx context.Context, key string) error {
+	_, err := s.propose(ctx, Op{Kind: OpDelete, Key: key})
+	return err
+}
+
+// CompareAndSwap sets key to value if it currently holds old, reporting
+// whether it did.
+func (s *Service) CompareAndSwap(ctx context.Context, key, old, value string) (bool, error) {
+	res, err := s.propose(ctx, Op{Kind: OpCompareAndSwap, Key: key, Old: old, Value: value})
+	return res.Swapped, err
+}
+
+func (s *Service) propose(ctx context.Context, op Op) (Result, error) {
+	_, result, err := s.raft.ProposeAndWait(ctx, op)
+	if err != nil {
+		return Result{}, err
+	}
+	res, _ := result.(Result)
+	return res, nil
+}
+
+// proposeInSession applies op as command seq of a client session.
+func (s *Service) proposeInSession(ctx context.Context, session SessionArgs, op Op) (Result, error) {
+	result, err := s.raft.ProposeInSession(ctx, session.ClientID, session.Seq, op)
+	if err != nil {
+		return Result{}, err
+	}
+	res, _ := result.(Result)
+	return res, nil
+}
+
+// SessionArgs identifies an operation within a client session.
+type SessionArgs struct {
+	ClientID int
+	Seq      int
+}
+
+// ReplyStatus tells the client to retry the operation with another server,
+// to retry it with the same one, or to open a new session. Retrying an
+// operation in its session never applies it twice.
+type ReplyStatus struct {
+	// WrongLeader is set when the server is not the leader, or can't act as
+	// one: it stopped, lost leadership or failed.
+	WrongLeader bool
+	// Retry is set when the operation may not have been applied: it was
+	// dropped by a change of leader, replaced by a snapshot or timed out.
+	Retry          bool
+	SessionExpired bool
+	// StaleSequence is set for an operation older than the last one the
+	// session applied, which the client did not send in order.
+	StaleSequence bool
+}
+
+type RegisterArgs struct{}
+
+type RegisterReply struct {
+	ReplyStatus
+	ClientID int
+}
+
+type GetArgs struct {
+	SessionArgs
+	Key string
+}
+
+type GetReply struct {
+	ReplyStatus
+	Value string
+	Found bool
+}
+
+type PutArgs struct {
+	SessionArgs
+	Key   string
+	Value string
+}
+
+type PutReply struct {
+	ReplyStatus
+}
+
+type DeleteArgs struct {
+	SessionArgs
+	Key string
+}
+
+type DeleteReply struct {
+	ReplyStatus
+}
+
+type CompareAndSwapArgs struct {
+	SessionArgs
+	Key   string
+	Old   string
+	Value string
+}
+
+type CompareAndSwapReply struct {
+	ReplyStatus
+	Swapped bool
+}
+
+// statusReply is implemented by the replies of the KV RPCs.
+type statusReply interface {
+	status() ReplyStatus
+}
+
+func (r *ReplyStatus) status() ReplyStatus { return *r }
+
+// NewRPCServer returns a net/rpc server exposing svc as the "KV" service.
+func NewRPCServer(svc *Service) (*rpc.Server, error) {
+	server := rpc.NewServer()
+	if err := server.RegisterName("KV", &rpcService{svc}); err != nil {
+		return nil, err
+	}
+	return server, nil
+}
+
+// rpcService adapts Service to net/rpc. Instead of returning the errors of the
+// raft package, it sets the matching ReplyStatus field, so clients can tell
+// whether to retry. Any other error reaches the client as an rpc.ServerError.
+type rpcService struct {
+	svc *Service
+}
+
+func (r *rpcService) Register(args RegisterArgs, reply *RegisterReply) error {
+	ctx, cancel := context.WithTimeout(context.Background(), r.svc.timeout)
+	defer cancel()
+	var err error
+	reply.ClientID, err = r.svc.raft.RegisterSession(ctx)
+	return r.wrap(err, &reply.ReplyStatus)
+}
+
+func (r *rpcService) Get(args GetArgs, reply *GetReply) error {
+	res, err := r.propose(args.SessionArgs, Op{Kind: OpGet, Key: args.Key})
+	reply.Value, reply.Found = res.Value, res.Found
+	return r.wrap(err, &reply.ReplyStatus)
+}
+
+func (r *rpcService) Put(args PutArgs, reply *PutReply) error {
+	_, err := r.propose(args.SessionArgs, Op{Kind: OpPut, Key: args.Key, Value: args.Value})
+	return r.wrap(err, &reply.ReplyStatus)
+}
+
+func (r *rpcService) Delete(args DeleteArgs, reply *DeleteReply) error {
+	_, err := r.propose(args.SessionArgs, Op{Kind: OpDelete, Key: args.Key})
+	return r.wrap(err, &reply.ReplyStatus)
+}
+
+func (r *rpcService) CompareAndSwap(args CompareAndSwapArgs, reply *CompareAndSwapReply) error {
+	res, err := r.propose(args.SessionArgs, Op{Kind: OpCompareAndSwap, Key: args.Key, Old: args.Old, Value: args.Value})
+	reply.Swapped = res.Swapped
+	return r.wrap(err, &reply.ReplyStatus)
+}
+
+func (r *rpcService) propose(session SessionArgs, op Op) (Result, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.svc.timeout)
+	defer cancel()
+	return r.svc.proposeInSession(ctx, session, op)
+}
+
+func (r *rpcService) wrap(err error, status *ReplyStatus) error {
+	switch {
+	case err == nil:
+	case errors.Is(err, raft.ErrNotLeader), errors.Is(err, raft.ErrStopped), errors.Is(err, raft.ErrLeadershipLost):
+		status.WrongLeader = true
+	case r.svc.raft.Err() != nil:
+		// A failed module returns its storage error.
+		status.WrongLeader = true
+	case errors.Is(err, raft.ErrProposalDropped), errors.Is(err, raft.ErrProposalUnknown), errors.Is(err, context.DeadlineExceeded):
+		status.Retry = true
+	case errors.Is(err, raft.ErrSessionExpired):
+		status.SessionExpired = true
+	case errors.Is(err, raft.ErrStaleSequence):
+		status.StaleSequence = true
+	default:
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+// Package kv is a replicated key-value store built on a raft
+// ConsensusModule. Every operation, reads included, goes through the log, so
+// all of them are linearizable.
+package kv
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"sync"
+
+	"raft"
+)
+
+func init() {
+	gob.Register(Op{})
+	// Results are cached in client sessions, which are part of snapshots.
+	gob.Register(Result{})
+}
+
+type OpKind int
+
+const (
+	OpGet OpKind = iota
+	OpPut
+	OpDelete
+	OpCompareAndSwap
+)
+
+func (k OpKind) String() string {
+	switch k {
+	case OpGet:
+		return "Get"
+	case OpPut:
+		return "Put"
+	case OpDelete:
+		return "Delete"
+	case OpCompareAndSwap:
+		return "CompareAndSwap"
+	default:
+		return fmt.Sprintf("OpKind(%d)", int(k))
+	}
+}
+
+// Op is the command the store replicates for each operation.
+type Op struct {
+	Kind  OpKind
+	Key   string
+	Value string
+	// Old is the value CompareAndSwap expects to replace.
+	Old string
+}
+
+// Result is what applying an Op returns.
+type Result struct {
+	Value   string
+	Found   bool
+	Swapped bool
+}
+
+// Store is the FSM holding the key-value data.
+type Store struct {
+	mu   sync.Mutex
+	data map[string]string
+}
+
+func NewStore() *Store {
+	return &Store{data: make(map[string]string)}
+}
+
+func (s *Store) Apply(entry raft.CommitEntry) interface{} {
+	op, ok := entry.Command.(Op)
+	if !ok {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.apply(op)
+}
+
+// apply applies op. Expects s.mu to be locked.
+func (s *Store) apply(op Op) Result {
+	value, found := s.data[op.Key]
+	switch op.Kind {
+	case OpGet:
+		return Result{Value: value, Found: found}
+	case OpPut:
+		s.data[op.Key] = op.Value
+		return Result{Value: op.Value, Found: true}
+	case OpDelete:
+		delete(s.data, op.Key)
+		return Result{}
+	case OpCompareAndSwap:
+		if !found || value != op.Old {
+			return Result{Value: value, Found: found}
+		}
+		s.data[op.Key] = op.Value
+		return Result{Value: op.Value, Found: true, Swapped: true}
+	}
+	return Result{}
+}
+
+func (s *Store) Snapshot() ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var data bytes.Buffer
+	if err := gob.NewEncoder(&data).Encode(s.data); err != nil {
+		return nil, err
+	}
+	return data.Bytes(), nil
+}
+
+func (s *Store) Restore(snapshot io.Reader) error {
+	data := make(map[string]string)
+	if err := gob.NewDecoder(snapshot).Decode(&data); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data = data
+	return nil
+}
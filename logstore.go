@@ -0,0 +1,188 @@
+package raft
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"sync"
+)
+
+// LogStore persists log entries by index, separately from the term and vote.
+// It holds the entries from FirstIndex to LastIndex inclusive, and is empty
+// when LastIndex is FirstIndex-1.
+type LogStore interface {
+	FirstIndex() int
+	LastIndex() int
+	// Entries returns the entries in [lo, hi).
+	Entries(lo, hi int) ([]LogEntry, error)
+	// Append stores entries following LastIndex.
+	Append(entries []LogEntry) error
+	// TruncateSuffix deletes the entries from index onwards.
+	TruncateSuffix(index int) error
+	// TruncatePrefix deletes the entries before index. If index is past
+	// LastIndex the store becomes empty, with FirstIndex set to index.
+	TruncatePrefix(index int) error
+}
+
+// StorageLogStore is a LogStore that keeps each entry under its own key in a
+// Storage, so appending or truncating only touches the affected entries.
+type StorageLogStore struct {
+	mu      sync.Mutex
+	storage Storage
+	first   int
+	last    int
+}
+
+func NewStorageLogStore(storage Storage) (*StorageLogStore, error) {
+	ls := &StorageLogStore{
+		storage: storage,
+		first:   0,
+		last:    -1,
+	}
+	var bounds logBounds
+	have, err := getGob(storage, "log/bounds", &bounds)
+	if err != nil {
+		return nil, err
+	}
+	if have {
+		if bounds.Last < bounds.First-1 {
+			return nil, fmt.Errorf("log bounds out of order: first=%d, last=%d", bounds.First, bounds.Last)
+		}
+		ls.first, ls.last = bounds.First, bounds.Last
+	}
+	return ls, nil
+}
+
+// logBounds is how StorageLogStore persists first and last, under a single
+// key so that a crash can't leave one updated without the other.
+type logBounds struct {
+	First, Last int
+}
+
+func (ls *StorageLogStore) FirstIndex() int {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	return ls.first
+}
+
+func (ls *StorageLogStore) LastIndex() int {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	return ls.last
+}
+
+func (ls *StorageLogStore) Entries(lo, hi int) ([]LogEntry, error) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	if hi < lo {
+		return nil, fmt.Errorf("invalid log range [%d, %d)", lo, hi)
+	}
+	entries := make([]LogEntry, 0, hi-lo)
+	for i := lo; i < hi; i++ {
+		var entry LogEntry
+		have, err := getGob(ls.storage, entryKey(i), &entry)
+		if err != nil {
+			return nil, err
+		}
+		if !have {
+			return nil, fmt.Errorf("log entry %d not found in storage", i)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func (ls *StorageLogStore) Append(entries []LogEntry) error {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	if len(entries) == 0 {
+		return nil
+	}
+	for i, entry := range entries {
+		if err := setGob(ls.storage, entryKey(ls.last+1+i), entry); err != nil {
+			return err
+		}
+	}
+	ls.last += len(entries)
+	return ls.persistBounds()
+}
+
+func (ls *StorageLogStore) TruncateSuffix(index int) error {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	if index > ls.last {
+		return nil
+	}
+	if index < ls.first {
+		index = ls.first
+	}
+	oldLast := ls.last
+	ls.last = index - 1
+	if err := ls.persistBounds(); err != nil {
+		return err
+	}
+	for i := index; i <= oldLast; i++ {
+		if err := ls.storage.Delete(entryKey(i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ls *StorageLogStore) TruncatePrefix(index int) error {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	if index <= ls.first {
+		return nil
+	}
+	oldFirst, oldLast := ls.first, ls.last
+	ls.first = index
+	if ls.last < index-1 {
+		ls.last = index - 1
+	}
+	if err := ls.persistBounds(); err != nil {
+		return err
+	}
+	for i := oldFirst; i < index && i <= oldLast; i++ {
+		if err := ls.storage.Delete(entryKey(i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// persistBounds stores first and last. Entries outside them are ignored, so
+// they are persisted before deleting entries and after adding them.
+func (ls *StorageLogStore) persistBounds() error {
+	return setGob(ls.storage, "log/bounds", logBounds{First: ls.first, Last: ls.last})
+}
+
+func entryKey(index int) string {
+	return fmt.Sprintf("log/%d", index)
+}
+
+// setGob stores the gob encoding of value under key.
+func setGob(storage Storage, key string, value interface{}) error {
+	var data bytes.Buffer
+	if err := gob.NewEncoder(&data).Encode(value); err != nil {
+		return fmt.Errorf("encode %s: %w", key, err)
+	}
+	return storage.Set(key, data.Bytes())
+}
+
+// getGob decodes the value stored under key into value, reporting whether
+// the key was found.
+func getGob(storage Storage, key string, value interface{}) (bool, error) {
+	data, have, err := storage.Get(key)
+	if err != nil || !have {
+		return false, err
+	}
+	if err := gob.NewDecoder(bytes.NewBuffer(data)).Decode(value); err != nil {
+		return false, fmt.Errorf("decode %s: %w", key, err)
+	}
+	return true, nil
+}
@@ -0,0 +1,62 @@
+package raft
+
+import "testing"
+
+func TestStorageLogStoreTruncation(t *testing.T) {
+	storage := NewMapStorage()
+	ls, err := NewStorageLogStore(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ls.Append([]LogEntry{{Command: 0, Term: 1}, {Command: 1, Term: 1}, {Command: 2, Term: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ls.TruncateSuffix(2); err != nil {
+		t.Fatal(err)
+	}
+	if err := ls.Append([]LogEntry{{Command: 20, Term: 2}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ls.TruncatePrefix(1); err != nil {
+		t.Fatal(err)
+	}
+
+	ls, err = NewStorageLogStore(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ls.FirstIndex() != 1 || ls.LastIndex() != 2 {
+		t.Fatalf("got first=%d last=%d, want 1 and 2", ls.FirstIndex(), ls.LastIndex())
+	}
+	entries, err := ls.Entries(1, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entries[0].Command != 1 || entries[1].Command != 20 || entries[1].Term != 2 {
+		t.Errorf("got entries %v", entries)
+	}
+	if _, have, _ := storage.Get(entryKey(0)); have {
+		t.Errorf("entry 0 is still in storage after TruncatePrefix")
+	}
+
+	// Truncating past the end leaves an empty store starting at that index.
+	if err := ls.TruncatePrefix(5); err != nil {
+		t.Fatal(err)
+	}
+	if ls.FirstIndex() != 5 || ls.LastIndex() != 4 {
+		t.Errorf("got first=%d last=%d, want 5 and 4", ls.FirstIndex(), ls.LastIndex())
+	}
+	if len(storage.m) != 1 {
+		t.Errorf("got %d keys in storage, want only the bounds", len(storage.m))
+	}
+}
+
+func TestStorageLogStoreEntriesInvalidRange(t *testing.T) {
+	ls, err := NewStorageLogStore(NewMapStorage())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ls.Entries(3, 1); err == nil {
+		t.Errorf("Entries(3, 1) succeeded")
+	}
+}
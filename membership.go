@@ -0,0 +1,295 @@
+package raft
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+var (
+	ErrNotLeader              = errors.New("raft: not the leader")
+	ErrLeadershipLost         = errors.New("raft: leadership lost before the operation completed")
+	ErrConfigChangeInProgress = errors.New("raft: a configuration change is already in progress")
+	ErrNotLearner             = errors.New("raft: server is not a learner")
+	ErrLearnerNotCaughtUp     = errors.New("raft: learner has not caught up with the leader")
+)
+
+func init() {
+	gob.Register(ConfigurationChange{})
+}
+
+// Configuration is the set of servers whose votes count towards elections and
+// commitment. While OldVoters is non-nil the cluster is in joint consensus
+// (C_old,new) and decisions need separate majorities of both sets. Learners
+// receive the log and apply commits, but never vote and are not counted
+// towards any majority.
+type Configuration struct {
+	Voters    []int
+	OldVoters []int
+	Learners  []int
+}
+
+// ConfigurationChange is the command of an EntryConfiguration log entry, which
+// changes the cluster configuration. It takes effect as soon as it is appended to a log.
+type ConfigurationChange struct {
+	Configuration Configuration
+}
+
+func (c Configuration) isJoint() bool {
+	return c.OldVoters != nil
+}
+
+func (c Configuration) isVoter(id int) bool {
+	return containsId(c.Voters, id) || containsId(c.OldVoters, id)
+}
+
+// members returns every server in the configuration, in ascending order.
+func (c Configuration) members() []int {
+	ids := append([]int(nil), c.Voters...)
+	for _, id := range append(append([]int(nil), c.OldVoters...), c.Learners...) {
+		if !containsId(ids, id) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// hasQuorum reports whether the servers for which granted returns true form a
+// majority of the configuration.
+func (c Configuration) hasQuorum(granted func(id int) bool) bool {
+	if !isMajority(c.Voters, granted) {
+		return false
+	}
+	return !c.isJoint() || isMajority(c.OldVoters, granted)
+}
+
+// quorumTime returns the latest time t such that a quorum of the
+// configuration has at(id) no earlier than t.
+func (c Configuration) quorumTime(at func(id int) time.Time) time.Time {
+	t := majorityTime(c.Voters, at)
+	if c.isJoint() {
+		if old := majorityTime(c.OldVoters, at); old.Before(t) {
+			t = old
+		}
+	}
+	return t
+}
+
+func majorityTime(ids []int, at func(id int) time.Time) time.Time {
+	times := make([]time.Time, 0, len(ids))
+	for _, id := range ids {
+		times = append(times, at(id))
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i].After(times[j]) })
+	return times[len(times)/2]
+}
+
+func isMajority(ids []int, granted func(id int) bool) bool {
+	count := 0
+	for _, id := range ids {
+		if granted(id) {
+			count++
+		}
+	}
+	return count*2 > len(ids)
+}
+
+func removeId(ids []int, id int) []int {
+	var result []int
+	for _, i := range ids {
+		if i != id {
+			result = append(result, i)
+		}
+	}
+	return result
+}
+
+func sameIds(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, id := range a {
+		if !containsId(b, id) {
+			return false
+		}
+	}
+	return true
+}
+
+func containsId(ids []int, id int) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
+
+// AddServer adds serverId to the cluster as a voter. It blocks until the
+// change has committed, and must be called on the leader.
+func (cm *ConsensusModule) AddServer(serverId int) error {
+	return cm.changeConfiguration(func(c Configuration) (Configuration, error) {
+		if containsId(c.Voters, serverId) {
+			return c, nil
+		}
+		return Configuration{
+			Voters:   append(append([]int(nil), c.Voters...), serverId),
+			Learners: removeId(c.Learners, serverId),
+		}, nil
+	})
+}
+
+// AddLearner adds serverId to the cluster as a learner. It blocks until the
+// change has committed, and must be called on the leader.
+func (cm *ConsensusModule) AddLearner(serverId int) error {
+	return cm.changeConfiguration(func(c Configuration) (Configuration, error) {
+		if c.isVoter(serverId) {
+			return c, fmt.Errorf("raft: server %d is already a voter", serverId)
+		}
+		if containsId(c.Learners, serverId) {
+			return c, nil
+		}
+		return Configuration{
+			Voters:   c.Voters,
+			Learners: append(append([]int(nil), c.Learners...), serverId),
+		}, nil
+	})
+}
+
+// PromoteLearner turns the learner serverId into a voter, once its log has
+// caught up with the leader's commit index. It blocks until the change has
+// committed, and must be called on the leader.
+func (cm *ConsensusModule) PromoteLearner(serverId int) error {
+	return cm.changeConfiguration(func(c Configuration) (Configuration, error) {
+		if !containsId(c.Learners, serverId) {
+			return c, ErrNotLearner
+		}
+		if cm.matchIndex[serverId] < cm.commitIndex {
+			return c, ErrLearnerNotCaughtUp
+		}
+		return Configuration{
+			Voters:   append(append([]int(nil), c.Voters...), serverId),
+			Learners: removeId(c.Learners, serverId),
+		}, nil
+	})
+}
+
+// RemoveServer removes serverId, voter or learner, from the cluster. It
+// blocks until the change has committed, and must be called on the leader. A
+// leader that removes itself steps down once the change commits.
+func (cm *ConsensusModule) RemoveServer(serverId int) error {
+	return cm.changeConfiguration(func(c Configuration) (Configuration, error) {
+		voters := removeId(c.Voters, serverId)
+		if len(voters) == 0 {
+			return c, errors.New("raft: cannot remove the last voter")
+		}
+		return Configuration{
+			Voters:   voters,
+			Learners: removeId(c.Learners, serverId),
+		}, nil
+	})
+}
+
+// changeConfiguration moves the cluster to the configuration returned by
+// next. Changes to the voters go through a joint configuration first;
+// advanceConfiguration appends the final one once the joint entry commits.
+func (cm *ConsensusModule) changeConfiguration(next func(c Configuration) (Configuration, error)) error {
+	cm.mu.Lock()
+	if !cm.isLeader() {
+		cm.mu.Unlock()
+		return ErrNotLeader
+	}
+	if cm.configChangeDone != nil || cm.configuration.isJoint() || cm.configurationIndex > cm.commitIndex {
+		cm.mu.Unlock()
+		return ErrConfigChangeInProgress
+	}
+	c, err := next(cm.configuration)
+	if err != nil || sameIds(c.Voters, cm.configuration.Voters) && sameIds(c.Learners, cm.configuration.Learners) {
+		cm.mu.Unlock()
+		return err
+	}
+	if !sameIds(c.Voters, cm.configuration.Voters) {
+		c.OldVoters = cm.configuration.Voters
+	}
+	done := make(chan error, 1)
+	cm.configChangeDone = done
+	cm.appendConfiguration(c)
+	cm.mu.Unlock()
+	cm.triggerAE()
+	return <-done
+}
+
+// appendConfiguration appends a configuration entry to the leader's log.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) appendConfiguration(c Configuration) {
+	if err := cm.appendLog(LogEntry{Command: ConfigurationChange{c}, Term: cm.currentTerm, Type: EntryConfiguration}); err != nil {
+		cm.fail(err)
+		return
+	}
+	cm.refreshConfiguration()
+	cm.debug("... appended configuration %+v at index %d", c, cm.configurationIndex)
+}
+
+// advanceConfiguration is called by the leader when commitIndex moves. Once
+// the joint configuration commits it appends the final configuration, and
+// once that commits the pending change is complete. Expects cm.mu to be
+// locked.
+func (cm *ConsensusModule) advanceConfiguration() {
+	if cm.configurationIndex > cm.commitIndex {
+		return
+	}
+	if cm.configuration.isJoint() {
+		cm.appendConfiguration(Configuration{
+			Voters:   cm.configuration.Voters,
+			Learners: cm.configuration.Learners,
+		})
+		return
+	}
+	if cm.configChangeDone != nil {
+		cm.configChangeDone <- nil
+		cm.configChangeDone = nil
+	}
+	if !containsId(cm.configuration.Voters, cm.id) {
+		cm.debug("removed from configuration, stepping down")
+		cm.becomeFollower(cm.currentTerm)
+	}
+}
+
+// refreshConfiguration sets the current configuration to the latest one in
+// the log, which may be uncommitted. Expects cm.mu to be locked.
+func (cm *ConsensusModule) refreshConfiguration() {
+	cm.configuration, cm.configurationIndex = cm.configurationAt(cm.logLen() - 1)
+	if cm.isLeader() {
+		for _, peerId := range cm.peers() {
+			if _, ok := cm.nextIndex[peerId]; !ok {
+				cm.nextIndex[peerId] = cm.logLen()
+				cm.matchIndex[peerId] = -1
+			}
+		}
+	}
+}
+
+// configurationAt returns the configuration in effect at index, and the index
+// of the entry that introduced it.
+func (cm *ConsensusModule) configurationAt(index int) (Configuration, int) {
+	for i := index; i > cm.lastIncludedIndex; i-- {
+		if entry := cm.log[cm.logPos(i)]; entry.Type == EntryConfiguration {
+			return entry.Command.(ConfigurationChange).Configuration, i
+		}
+	}
+	return cm.snapshotConfiguration, cm.lastIncludedIndex
+}
+
+// peers returns the other servers in the current configuration.
+func (cm *ConsensusModule) peers() []int {
+	var peerIds []int
+	for _, id := range cm.configuration.members() {
+		if id != cm.id {
+			peerIds = append(peerIds, id)
+		}
+	}
+	return peerIds
+}
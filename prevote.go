@@ -0,0 +1,89 @@
+package raft
+
+import "time"
+
+// SetPreVote enables or disables the pre-vote phase. With pre-vote, a server
+// whose election timer expires first asks its peers whether they would vote
+// for it, without incrementing its term, and only starts a real election if
+// a majority would. This keeps a server that was partitioned away from
+// disrupting the cluster when it reconnects.
+func (cm *ConsensusModule) SetPreVote(enabled bool) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	cm.config.PreVote = enabled
+}
+
+// startPreVote runs a pre-vote round for the term following currentTerm.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) startPreVote() {
+	savedCurrentTerm := cm.currentTerm
+	cm.electionResetTime = time.Now()
+	cm.debug("starts PreVote (currentTerm=%d)", savedCurrentTerm)
+
+	votesReceived := map[int]bool{cm.id: true}
+
+	for _, peerId := range cm.peers() {
+		go func(peerId int) {
+			cm.mu.Lock()
+			savedLastLogIndex, savedLastLogTerm := cm.lastLogIndexAndTerm()
+			cm.mu.Unlock()
+
+			args := PreVoteArgs{
+				Term:         savedCurrentTerm + 1,
+				CandidateId:  cm.id,
+				LastLogIndex: savedLastLogIndex,
+				LastLogTerm:  savedLastLogTerm,
+			}
+			var reply PreVoteReply
+			cm.debug("sending PreVote to %d: %+v", peerId, args)
+			err := cm.transport.PreVote(peerId, args, &reply)
+			if err == nil {
+				cm.mu.Lock()
+				defer cm.mu.Unlock()
+				cm.debug("received PreVoteReply %+v", reply)
+				if reply.Term > cm.currentTerm {
+					cm.debug("term out of date in PreVoteReply")
+					cm.becomeFollower(reply.Term)
+					return
+				}
+				if cm.currentTerm != savedCurrentTerm || !cm.isFollower() && !cm.isCandidate() {
+					cm.debug("while waiting for PreVote reply, state = %s, term = %d", cm.state, cm.currentTerm)
+					return
+				}
+				if reply.VoteGranted && !votesReceived[peerId] {
+					votesReceived[peerId] = true
+					if cm.configuration.hasQuorum(func(id int) bool { return votesReceived[id] }) {
+						cm.debug("wins PreVote with %d votes", len(votesReceived))
+						cm.startElection(false)
+					}
+				}
+			}
+		}(peerId)
+	}
+
+	go cm.runElectionTimer()
+}
+
+// PreVote reports whether this server would vote for the candidate in
+// args.Term. It changes no state: neither currentTerm nor votedFor.
+func (cm *ConsensusModule) PreVote(args PreVoteArgs, reply *PreVoteReply) error {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	if cm.isDead() {
+		return nil
+	}
+	if cm.isFailed() {
+		return cm.err
+	}
+	lastLogIndex, lastLogTerm := cm.lastLogIndexAndTerm()
+	cm.debug("PreVote: %+v [currentTerm=%d, log index/term=(%d, %d)]", args, cm.currentTerm, lastLogIndex, lastLogTerm)
+
+	// A server that heard from a leader within the minimum election timeout
+	// believes the leader is still alive and refuses.
+	reply.VoteGranted = args.Term > cm.currentTerm && !cm.leaderAlive() &&
+		(args.LastLogTerm > lastLogTerm || args.LastLogTerm == lastLogTerm && args.LastLogIndex >= lastLogIndex)
+	reply.Term = cm.currentTerm
+	cm.debug("... PreVote reply: %+v", reply)
+	return nil
+}
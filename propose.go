@@ -0,0 +1,100 @@
+package raft
+
+import (
+	"context"
+	"errors"
+)
+
+var (
+	ErrProposalDropped = errors.New("raft: proposal was overwritten by another leader's entry")
+	ErrProposalUnknown = errors.New("raft: proposal was replaced by a snapshot before its outcome was known")
+	ErrStopped         = errors.New("raft: stopped")
+)
+
+// proposal is a command submitted through ProposeAndWait, waiting for the
+// entry at its index to be applied.
+type proposal struct {
+	term int
+	done chan proposalResult
+}
+
+type proposalResult struct {
+	result interface{}
+	err    error
+}
+
+// ProposeAndWait submits command like Submit and waits until it has been
+// committed and applied to the FSM, returning its log index and the result
+// of FSM.Apply. It fails with ErrNotLeader if this server is not the leader,
+// and with ErrProposalDropped if the entry is truncated from the log after a
+// change of leadership. If ctx ends first the command may still be committed
+// later.
+func (cm *ConsensusModule) ProposeAndWait(ctx context.Context, command interface{}) (int, interface{}, error) {
+	return cm.propose(ctx, LogEntry{Command: command})
+}
+
+// ProposeData is like ProposeAndWait for a command the application has
+// encoded itself, as with SubmitData.
+func (cm *ConsensusModule) ProposeData(ctx context.Context, data []byte) (int, interface{}, error) {
+	return cm.propose(ctx, LogEntry{Data: data, IsData: true})
+}
+
+func (cm *ConsensusModule) propose(ctx context.Context, entry LogEntry) (int, interface{}, error) {
+	cm.mu.Lock()
+	index, term, isLeader := cm.submit(entry)
+	if !isLeader {
+		err := ErrNotLeader
+		if cm.isFailed() {
+			err = cm.err
+		}
+		cm.mu.Unlock()
+		return -1, nil, err
+	}
+	p := &proposal{term: term, done: make(chan proposalResult, 1)}
+	cm.proposals[index] = p
+	cm.mu.Unlock()
+	cm.triggerAE()
+
+	select {
+	case r := <-p.done:
+		return index, r.result, r.err
+	case <-ctx.Done():
+		cm.mu.Lock()
+		defer cm.mu.Unlock()
+		if cm.proposals[index] == p {
+			delete(cm.proposals, index)
+		}
+		return index, nil, ctx.Err()
+	}
+}
+
+// resolveProposal reports the outcome to the proposal waiting for index, if
+// any. Expects cm.mu to be locked.
+func (cm *ConsensusModule) resolveProposal(index int, result interface{}, err error) {
+	if p, ok := cm.proposals[index]; ok {
+		p.done <- proposalResult{result, err}
+		delete(cm.proposals, index)
+	}
+}
+
+// resolveProposalsFrom reports err to the proposals waiting for index from
+// onwards. Expects cm.mu to be locked.
+func (cm *ConsensusModule) resolveProposalsFrom(from int, err error) {
+	for index := range cm.proposals {
+		if index >= from {
+			cm.resolveProposal(index, nil, err)
+		}
+	}
+}
+
+// applied resolves the proposal waiting for index once the entry there has
+// been applied with the given result. Expects cm.mu to be locked.
+func (cm *ConsensusModule) applied(index int, term int, result interface{}) {
+	if p, ok := cm.proposals[index]; ok {
+		if p.term == term {
+			cm.resolveProposal(index, result, nil)
+		} else {
+			cm.resolveProposal(index, nil, ErrProposalDropped)
+		}
+	}
+}
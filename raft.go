@@ -1,11 +1,9 @@
 package raft
 
 import (
-	"bytes"
-	"encoding/gob"
 	"fmt"
-	"log"
 	"math/rand"
+	"sort"
 	"sync"
 	"time"
 )
@@ -13,17 +11,26 @@ import (
 type ConsensusModule struct {
 	mu sync.Mutex
 
-	id      int
-	peerIds []int
-	server  *Server
-	storage Storage
-
-	currentTerm       int
-	votedFor          int
+	id        int
+	config    Config
+	transport Transport
+	storage   Storage
+	logStore  LogStore
+
+	currentTerm int
+	votedFor    int
+	// persistedTerm and persistedVotedFor are the currentTerm and votedFor
+	// last persisted, with persistedTerm -1 before anything is.
+	persistedTerm     int
+	persistedVotedFor int
 	state             CMState
+	// leaderId is the leader of currentTerm as far as this server knows, or
+	// -1.
+	leaderId          int
 	electionResetTime time.Time
+	leaderContactTime time.Time
 
-	commitChan         chan<- CommitEntry
+	fsm                FSM
 	triggerAEChan      chan struct{}
 	newCommitReadyChan chan struct{}
 
@@ -31,39 +38,161 @@ type ConsensusModule struct {
 	commitIndex int
 	lastApplied int
 
+	// applyMu is held while the FSM applies entries; fsmApplied is the index
+	// of the last entry it has applied. fsmApplied is written with both
+	// applyMu and mu held, so either is enough to read it. applyMu is taken
+	// before mu.
+	applyMu    sync.Mutex
+	fsmApplied int
+
+	// lastIncludedIndex and lastIncludedTerm describe the last entry covered by
+	// snapshot; cm.log holds the entries that follow it.
+	lastIncludedIndex int
+	lastIncludedTerm  int
+	snapshot          []byte
+	snapshotPending   bool
+
 	nextIndex  map[int]int
 	matchIndex map[int]int
+	// replicators holds the leader's replication worker for each peer.
+	replicators map[int]*replicator
+	// ackTime holds, per peer, the send time of the latest request it answered
+	// in the leader's term.
+	ackTime         map[int]time.Time
+	leaderStartTime time.Time
+
+	leaseExpiry time.Time
+
+	// configuration is the latest configuration in the log, appended at
+	// configurationIndex. snapshotConfiguration is the one in effect at
+	// lastIncludedIndex.
+	configuration         Configuration
+	configurationIndex    int
+	snapshotConfiguration Configuration
+	configChangeDone      chan error
+
+	// transferTarget is the server leadership is being transferred to, or -1.
+	transferTarget int
+	transferDone   chan error
+	timeoutNowSent bool
+
+	// proposals holds the ProposeAndWait calls waiting for their entry, by
+	// log index.
+	proposals map[int]*proposal
+
+	// rand is the source of the election timeouts; see Config.RandSeed.
+	rand *rand.Rand
+
+	// err is the storage error that moved the ConsensusModule to Failed.
+	err error
 }
 
 type CommitEntry struct {
 	Command interface{}
-	Index   int
-	Term    int
+	// Data is the command of an entry submitted with SubmitData, if IsData
+	// is set. It is never nil then, even for an empty command.
+	Data   []byte
+	IsData bool
+	Index  int
+	Term   int
+	Type   EntryType
+
+	// Snapshot is set when the entry carries a snapshot that replaces the
+	// application state up to and including Index, instead of a command.
+	Snapshot []byte
+}
+
+// EntryType tells what a log entry is for. Only EntryCommand entries reach
+// the FSM; the other types are the ConsensusModule's own.
+type EntryType int
+
+const (
+	// EntryCommand entries carry a command for the FSM.
+	EntryCommand EntryType = iota
+	// EntryNoop entries carry nothing. A new leader appends one so that the
+	// entries of earlier terms commit without waiting for a Submit.
+	EntryNoop
+	// EntryConfiguration entries carry a ConfigurationChange.
+	EntryConfiguration
+)
+
+func (t EntryType) String() string {
+	switch t {
+	case EntryCommand:
+		return "Command"
+	case EntryNoop:
+		return "Noop"
+	case EntryConfiguration:
+		return "Configuration"
+	default:
+		return fmt.Sprintf("EntryType(%d)", int(t))
+	}
 }
 
 type LogEntry struct {
 	Command interface{}
-	Term    int
+	// Data is the command of an entry submitted with SubmitData. Command is
+	// gob-encoded along with the name of its type; Data is persisted and
+	// replicated as the application encoded it. IsData marks such an entry,
+	// since gob decodes an empty Data as nil.
+	Data   []byte
+	IsData bool
+	Term   int
+	Type   EntryType
 }
 
-func NewConsensusModule(id int, peerIds []int, server *Server, ready <-chan interface{}, storage Storage, commitChan chan<- CommitEntry) *ConsensusModule {
+// NewConsensusModule creates a ConsensusModule, returning an error only if
+// config is invalid. A failure to load the persisted state moves it to
+// Failed instead, which Err reports.
+func NewConsensusModule(id int, peerIds []int, config Config, transport Transport, ready <-chan interface{}, storage Storage, fsm FSM) (*ConsensusModule, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
 	cm := new(ConsensusModule)
 	cm.id = id
-	cm.peerIds = peerIds
-	cm.server = server
+	cm.config = config
+	cm.transport = transport
 	cm.state = Follower
 	cm.votedFor = -1
-	cm.commitChan = commitChan
-	cm.newCommitReadyChan = make(chan struct{}, 16)
+	cm.persistedTerm = -1
+	cm.leaderId = -1
+	cm.fsm = fsm
+	cm.newCommitReadyChan = make(chan struct{}, config.CommitChanBuffer)
 	cm.commitIndex = -1
 	cm.lastApplied = -1
+	cm.fsmApplied = -1
+	cm.lastIncludedIndex = -1
+	cm.lastIncludedTerm = -1
 	cm.nextIndex = make(map[int]int)
 	cm.matchIndex = make(map[int]int)
+	cm.replicators = make(map[int]*replicator)
+	cm.ackTime = make(map[int]time.Time)
+	cm.proposals = make(map[int]*proposal)
 	cm.storage = storage
 	cm.triggerAEChan = make(chan struct{}, 1)
+	cm.transferTarget = -1
+	seed := config.RandSeed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	cm.rand = rand.New(rand.NewSource(seed ^ int64(id)<<32))
+	if peerIds != nil {
+		voters := append([]int{id}, peerIds...)
+		sort.Ints(voters)
+		cm.snapshotConfiguration = Configuration{Voters: voters}
+	}
 
-	if cm.storage.HasData() {
-		cm.restoreFromStorage()
+	if err := cm.restore(); err != nil {
+		cm.fail(err)
+	} else {
+		cm.refreshConfiguration()
+		if cm.snapshotPending {
+			// Restore the FSM from the snapshot straight away.
+			cm.notifyCommitReady()
+		}
+	}
+	if transport != nil {
+		transport.Register(cm)
 	}
 
 	go func() {
@@ -74,91 +203,204 @@ func NewConsensusModule(id int, peerIds []int, server *Server, ready <-chan inte
 		cm.runElectionTimer()
 	}()
 
-	go cm.commitChanSender()
-	return cm
+	go cm.applier()
+	return cm, nil
 }
 
-func (cm *ConsensusModule) restoreFromStorage() {
-	termData, have := cm.storage.Get("currentTerm")
-	if have {
-		d := gob.NewDecoder(bytes.NewBuffer(termData))
-		err := d.Decode(&cm.currentTerm)
-		if err != nil {
-			log.Fatal(err)
-		}
-	} else {
-		log.Fatal("currentTerm not found in storage")
+// restore loads the persisted state, if there is any.
+func (cm *ConsensusModule) restore() error {
+	logStore, err := NewStorageLogStore(cm.storage)
+	if err != nil {
+		return err
 	}
-	votedForData, have := cm.storage.Get("votedFor")
-	if have {
-		d := gob.NewDecoder(bytes.NewBuffer(votedForData))
-		err := d.Decode(&cm.votedFor)
-		if err != nil {
-			log.Fatal(err)
-		}
-	} else {
-		log.Fatal("votedFor not found in storage")
+	cm.logStore = logStore
+	hasData, err := cm.storage.HasData()
+	if err != nil || !hasData {
+		return err
+	}
+	return cm.restoreFromStorage()
+}
+
+func (cm *ConsensusModule) restoreFromStorage() error {
+	// Without a hard state the server never voted, and term 0 is as good as
+	// any: the log entries stored before a crash keep their own terms.
+	var hardState persistedHardState
+	if have, err := getGob(cm.storage, "hardState", &hardState); err != nil {
+		return err
+	} else if have {
+		cm.currentTerm, cm.votedFor = hardState.CurrentTerm, hardState.VotedFor
+		cm.persistedTerm, cm.persistedVotedFor = cm.currentTerm, cm.votedFor
+	}
+	var snapshot persistedSnapshot
+	have, err := getGob(cm.storage, "snapshot", &snapshot)
+	if err != nil {
+		return err
 	}
-	logData, have := cm.storage.Get("log")
 	if have {
-		d := gob.NewDecoder(bytes.NewBuffer(logData))
-		err := d.Decode(&cm.log)
-		if err != nil {
-			log.Fatal(err)
+		cm.lastIncludedIndex = snapshot.LastIncludedIndex
+		cm.lastIncludedTerm = snapshot.LastIncludedTerm
+		cm.snapshot = snapshot.Data
+		cm.snapshotConfiguration = snapshot.Configuration
+		cm.commitIndex = cm.lastIncludedIndex
+		cm.snapshotPending = true
+	}
+	if first := cm.logStore.FirstIndex(); first > cm.lastIncludedIndex+1 {
+		return fmt.Errorf("log store starts at index %d, after the snapshot ending at %d", first, cm.lastIncludedIndex)
+	} else if first < cm.lastIncludedIndex+1 {
+		// The snapshot was persisted but not the compaction that follows it.
+		if err := cm.logStore.TruncatePrefix(cm.lastIncludedIndex + 1); err != nil {
+			return err
 		}
-	} else {
-		log.Fatal("log not found in storage")
 	}
+	cm.log, err = cm.logStore.Entries(cm.lastIncludedIndex+1, cm.logStore.LastIndex()+1)
+	return err
 }
 
-func (cm *ConsensusModule) persistToStorage() {
-	var termData bytes.Buffer
-	err := gob.NewEncoder(&termData).Encode(cm.currentTerm)
-	if err != nil {
-		log.Fatal(err)
+// persistedHardState is how currentTerm and votedFor are persisted, under a
+// single key so that a crash can't leave one updated without the other.
+type persistedHardState struct {
+	CurrentTerm int
+	VotedFor    int
+}
+
+// persistHardState persists currentTerm and votedFor, unless they are
+// unchanged since the last time.
+func (cm *ConsensusModule) persistHardState() error {
+	if cm.currentTerm == cm.persistedTerm && cm.votedFor == cm.persistedVotedFor {
+		return nil
+	}
+	if err := setGob(cm.storage, "hardState", persistedHardState{CurrentTerm: cm.currentTerm, VotedFor: cm.votedFor}); err != nil {
+		return err
 	}
-	cm.storage.Set("currentTerm", termData.Bytes())
+	cm.persistedTerm, cm.persistedVotedFor = cm.currentTerm, cm.votedFor
+	return nil
+}
 
-	var votedForData bytes.Buffer
-	err = gob.NewEncoder(&votedForData).Encode(cm.votedFor)
-	if err != nil {
-		log.Fatal(err)
+// appendLog appends entries to the log and persists them.
+func (cm *ConsensusModule) appendLog(entries ...LogEntry) error {
+	if err := cm.logStore.Append(entries); err != nil {
+		return err
 	}
-	cm.storage.Set("votedFor", votedForData.Bytes())
+	cm.log = append(cm.log, entries...)
+	return nil
+}
 
-	var logData bytes.Buffer
-	err = gob.NewEncoder(&logData).Encode(cm.log)
-	if err != nil {
-		log.Fatal(err)
+// truncateLog discards the log entries from index onwards.
+func (cm *ConsensusModule) truncateLog(index int) error {
+	if err := cm.logStore.TruncateSuffix(index); err != nil {
+		return err
 	}
-	cm.storage.Set("log", logData.Bytes())
+	cm.log = cm.log[:cm.logPos(index)]
+	cm.resolveProposalsFrom(index, ErrProposalDropped)
+	return nil
+}
+
+// persistedSnapshot is how the snapshot is persisted: its data and metadata
+// go under a single key, so a crash can't leave them out of step.
+type persistedSnapshot struct {
+	LastIncludedIndex int
+	LastIncludedTerm  int
+	Configuration     Configuration
+	Data              []byte
+}
+
+func (cm *ConsensusModule) persistSnapshot() error {
+	snapshot := persistedSnapshot{
+		LastIncludedIndex: cm.lastIncludedIndex,
+		LastIncludedTerm:  cm.lastIncludedTerm,
+		Configuration:     cm.snapshotConfiguration,
+		Data:              cm.snapshot,
+	}
+	if err := setGob(cm.storage, "snapshot", snapshot); err != nil {
+		return err
+	}
+	return cm.logStore.TruncatePrefix(cm.lastIncludedIndex + 1)
+}
+
+// fail moves the ConsensusModule to the Failed state after a storage error.
+// Its persistent state can no longer be trusted, so from then on it refuses
+// to vote or accept entries. Expects cm.mu to be locked.
+func (cm *ConsensusModule) fail(err error) {
+	if cm.isFailed() || cm.isDead() {
+		return
+	}
+	cm.debug("becomes Failed: %v", err)
+	cm.state = Failed
+	cm.err = err
+	cm.leaseExpiry = time.Time{}
+	cm.stopReplication()
+	if cm.configChangeDone != nil {
+		cm.configChangeDone <- err
+		cm.configChangeDone = nil
+	}
+	cm.abortTransfer(err)
+	cm.resolveProposalsFrom(0, err)
+}
+
+// Err returns the error that made the ConsensusModule fail, or nil.
+func (cm *ConsensusModule) Err() error {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	return cm.err
 }
 
 func (cm *ConsensusModule) debug(format string, args ...any) {
 	format = fmt.Sprintf("[%d] ", cm.id) + format
-	log.Printf(format, args...)
+	cm.config.logger().Printf(format, args...)
 }
 
-func (cm *ConsensusModule) Submit(command interface{}) bool {
+// Submit appends command to the leader's log, returning the index and term
+// it was appended at. If this server is not the leader it returns
+// isLeader=false, and the command is dropped. Even when Submit succeeds the
+// entry may later be overwritten by a new leader; ProposeAndWait reports
+// whether it was committed.
+//
+// The command is persisted and replicated with gob, so its concrete type must
+// be registered with gob.Register and keep its name across versions.
+// SubmitData leaves the encoding to the application instead.
+func (cm *ConsensusModule) Submit(command interface{}) (index int, term int, isLeader bool) {
+	return cm.submitEntry(LogEntry{Command: command})
+}
+
+// SubmitData is like Submit for a command the application has encoded
+// itself. FSM.Apply receives data in CommitEntry.Data.
+func (cm *ConsensusModule) SubmitData(data []byte) (index int, term int, isLeader bool) {
+	return cm.submitEntry(LogEntry{Data: data, IsData: true})
+}
+
+func (cm *ConsensusModule) submitEntry(entry LogEntry) (int, int, bool) {
 	cm.mu.Lock()
+	index, term, isLeader := cm.submit(entry)
+	cm.mu.Unlock()
+	if isLeader {
+		cm.triggerAE()
+	}
+	return index, term, isLeader
+}
 
-	cm.debug("Submit received by %v: %v", cm.state, command)
-	if cm.state == Leader {
-		cm.log = append(cm.log, LogEntry{command, cm.currentTerm})
-		cm.persistToStorage()
-		cm.debug("... log=%v", cm.log)
-		cm.mu.Unlock()
-		cm.triggerAEChan <- struct{}{}
-		return true
+// submit appends a command entry to the log if this server is the leader.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) submit(entry LogEntry) (int, int, bool) {
+	cm.debug("Submit received by %v: %+v", cm.state, entry)
+	if cm.state != Leader || cm.transferDone != nil {
+		return -1, cm.currentTerm, false
 	}
-	cm.mu.Unlock()
-	return false
+	entry.Term = cm.currentTerm
+	entry.Type = EntryCommand
+	if err := cm.appendLog(entry); err != nil {
+		cm.fail(err)
+		return -1, cm.currentTerm, false
+	}
+	cm.debug("... log=%v", cm.log)
+	return cm.logLen() - 1, cm.currentTerm, true
 }
 
-func (cm *ConsensusModule) Report() (id int, term int, isLeader bool) {
+// Report returns this server's ID and term, whether it is the leader, and the
+// leader it knows of for the term, or -1.
+func (cm *ConsensusModule) Report() (id int, term int, isLeader bool, leaderId int) {
 	cm.mu.Lock()
 	defer cm.mu.Unlock()
-	return cm.id, cm.currentTerm, cm.isLeader()
+	return cm.id, cm.currentTerm, cm.isLeader(), cm.leaderId
 }
 
 func (cm *ConsensusModule) RequestVote(args RequestVoteArgs, reply *RequestVoteReply) error {
@@ -168,9 +410,22 @@ func (cm *ConsensusModule) RequestVote(args RequestVoteArgs, reply *RequestVoteR
 	if cm.isDead() {
 		return nil
 	}
+	if cm.isFailed() {
+		return cm.err
+	}
 	lastLogIndex, lastLogTerm := cm.lastLogIndexAndTerm()
 	cm.debug("RequestVote: %+v [currentTerm=%d, votedFor=%d, log index/term=(%d, %d)]", args, cm.currentTerm, cm.votedFor, lastLogIndex, lastLogTerm)
 
+	// With lease reads, a server that believes the current leader is alive
+	// ignores the request, so that leases held by the leader stay valid,
+	// unless the leader itself asked the candidate to campaign.
+	if cm.config.LeaseRead && !args.LeadershipTransfer && cm.leaderAlive() {
+		cm.debug("... leader is alive, ignoring RequestVote")
+		reply.Term = cm.currentTerm
+		reply.VoteGranted = false
+		return nil
+	}
+
 	if args.Term > cm.currentTerm {
 		cm.debug("... term out of date in RequestVote")
 		cm.becomeFollower(args.Term)
@@ -185,7 +440,10 @@ func (cm *ConsensusModule) RequestVote(args RequestVoteArgs, reply *RequestVoteR
 		reply.VoteGranted = false
 	}
 	reply.Term = cm.currentTerm
-	cm.persistToStorage()
+	if err := cm.persistHardState(); err != nil {
+		cm.fail(err)
+		return err
+	}
 	cm.debug("... RequestVote reply: %+v", reply)
 	return nil
 }
@@ -197,12 +455,20 @@ func (cm *ConsensusModule) AppendEntries(args AppendEntriesArgs, reply *AppendEn
 	if cm.isDead() {
 		return nil
 	}
+	if cm.isFailed() {
+		return cm.err
+	}
 	cm.debug("AppendEntries: %+v [currentTerm=%d]", args, cm.currentTerm)
 
 	if args.Term > cm.currentTerm {
 		cm.debug("... term out of date in AppendEntries")
 		cm.becomeFollower(args.Term)
 	}
+	// Persist the term before the entries of the leader of that term.
+	if err := cm.persistHardState(); err != nil {
+		cm.fail(err)
+		return err
+	}
 
 	reply.Success = false
 	if args.Term == cm.currentTerm {
@@ -210,16 +476,29 @@ func (cm *ConsensusModule) AppendEntries(args AppendEntriesArgs, reply *AppendEn
 			cm.becomeFollower(args.Term)
 		}
 		cm.electionResetTime = time.Now()
-		if args.PrevLogIndex == -1 || (args.PrevLogIndex < len(cm.log) && args.PrevLogTerm == cm.log[args.PrevLogIndex].Term) {
+		cm.leaderContactTime = cm.electionResetTime
+		cm.leaderId = args.LeaderId
+		cm.observeTransferLeader(args.LeaderId)
+
+		if args.PrevLogIndex < cm.lastIncludedIndex {
+			// The entries up to lastIncludedIndex are already committed and compacted
+			// into the snapshot, so skip over them.
+			skip := intMin(cm.lastIncludedIndex-args.PrevLogIndex, len(args.Entries))
+			args.Entries = args.Entries[skip:]
+			args.PrevLogIndex = cm.lastIncludedIndex
+			args.PrevLogTerm = cm.lastIncludedTerm
+		}
+
+		if args.PrevLogIndex < cm.logLen() && args.PrevLogTerm == cm.termAt(args.PrevLogIndex) {
 			reply.Success = true
 			logInsertIndex := args.PrevLogIndex + 1
 			newEntriesIndex := 0
 
 			for {
-				if logInsertIndex >= len(cm.log) || newEntriesIndex >= len(args.Entries) {
+				if logInsertIndex >= cm.logLen() || newEntriesIndex >= len(args.Entries) {
 					break
 				}
-				if cm.log[logInsertIndex].Term != args.Entries[newEntriesIndex].Term {
+				if cm.termAt(logInsertIndex) != args.Entries[newEntriesIndex].Term {
 					break
 				}
 				logInsertIndex++
@@ -228,22 +507,35 @@ func (cm *ConsensusModule) AppendEntries(args AppendEntriesArgs, reply *AppendEn
 
 			if newEntriesIndex < len(args.Entries) {
 				cm.debug("... AppendEntries: appending entries %v from index %d", args.Entries[newEntriesIndex:], logInsertIndex)
-				cm.log = append(cm.log[:logInsertIndex], args.Entries[newEntriesIndex:]...)
+				if logInsertIndex < cm.logLen() {
+					if err := cm.truncateLog(logInsertIndex); err != nil {
+						cm.fail(err)
+						return err
+					}
+				}
+				if err := cm.appendLog(args.Entries[newEntriesIndex:]...); err != nil {
+					cm.fail(err)
+					return err
+				}
+				cm.refreshConfiguration()
 				cm.debug("... AppendEntries: log=%v", cm.log)
 			}
-			if args.LeaderCommit > cm.commitIndex {
-				cm.commitIndex = intMin(args.LeaderCommit, len(cm.log)-1)
+			// Only the entries up to the last one in the request are known to
+			// match the leader's; a request may carry fewer entries than the
+			// leader has, and the log may go on with stale ones.
+			if commitIndex := intMin(args.LeaderCommit, args.PrevLogIndex+len(args.Entries)); commitIndex > cm.commitIndex {
+				cm.commitIndex = commitIndex
 				cm.debug("... AppendEntries: setting commitIndex=%d", cm.commitIndex)
-				cm.newCommitReadyChan <- struct{}{}
+				cm.notifyCommitReady()
 			}
 		} else {
-			if args.PrevLogIndex >= len(cm.log) {
-				reply.ConflictIndex = len(cm.log)
+			if args.PrevLogIndex >= cm.logLen() {
+				reply.ConflictIndex = cm.logLen()
 				reply.ConflictTerm = -1
 			} else {
-				reply.ConflictTerm = cm.log[args.PrevLogIndex].Term
+				reply.ConflictTerm = cm.termAt(args.PrevLogIndex)
 				conflictIndex := args.PrevLogIndex
-				for conflictIndex > 0 && cm.log[conflictIndex-1].Term == reply.ConflictTerm {
+				for conflictIndex > cm.lastIncludedIndex+1 && cm.termAt(conflictIndex-1) == reply.ConflictTerm {
 					conflictIndex--
 				}
 				reply.ConflictIndex = conflictIndex
@@ -251,21 +543,124 @@ func (cm *ConsensusModule) AppendEntries(args AppendEntriesArgs, reply *AppendEn
 		}
 	}
 	reply.Term = cm.currentTerm
-	cm.persistToStorage()
 	cm.debug("AppendEntries reply: %+v", reply)
 	return nil
 }
 
+func (cm *ConsensusModule) InstallSnapshot(args InstallSnapshotArgs, reply *InstallSnapshotReply) error {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	if cm.isDead() {
+		return nil
+	}
+	if cm.isFailed() {
+		return cm.err
+	}
+	cm.debug("InstallSnapshot: lastIncludedIndex=%d, lastIncludedTerm=%d [currentTerm=%d]", args.LastIncludedIndex, args.LastIncludedTerm, cm.currentTerm)
+
+	if args.Term > cm.currentTerm {
+		cm.debug("... term out of date in InstallSnapshot")
+		cm.becomeFollower(args.Term)
+		if err := cm.persistHardState(); err != nil {
+			cm.fail(err)
+			return err
+		}
+	}
+
+	reply.Term = cm.currentTerm
+	if args.Term != cm.currentTerm {
+		return nil
+	}
+	if !cm.isFollower() {
+		cm.becomeFollower(args.Term)
+	}
+	cm.electionResetTime = time.Now()
+	cm.leaderContactTime = cm.electionResetTime
+	cm.leaderId = args.LeaderId
+	cm.observeTransferLeader(args.LeaderId)
+
+	if args.LastIncludedIndex <= cm.commitIndex {
+		cm.debug("... InstallSnapshot: already committed up to %d, ignoring", cm.commitIndex)
+		return nil
+	}
+
+	if args.LastIncludedIndex < cm.logLen() && cm.termAt(args.LastIncludedIndex) == args.LastIncludedTerm {
+		// The snapshot covers a prefix of our log; retain the entries following it.
+		// Proposals in that prefix are resolved once the snapshot is applied.
+		for index, p := range cm.proposals {
+			if index <= args.LastIncludedIndex && cm.termAt(index) != p.term {
+				cm.resolveProposal(index, nil, ErrProposalDropped)
+			}
+		}
+		cm.log = append([]LogEntry(nil), cm.log[cm.logPos(args.LastIncludedIndex)+1:]...)
+	} else {
+		if err := cm.logStore.TruncateSuffix(cm.lastIncludedIndex + 1); err != nil {
+			cm.fail(err)
+			return err
+		}
+		cm.log = nil
+		cm.resolveProposalsFrom(args.LastIncludedIndex+1, ErrProposalDropped)
+		cm.resolveProposalsFrom(0, ErrProposalUnknown)
+	}
+	cm.lastIncludedIndex = args.LastIncludedIndex
+	cm.lastIncludedTerm = args.LastIncludedTerm
+	cm.snapshot = args.Data
+	cm.snapshotConfiguration = args.Configuration
+	cm.refreshConfiguration()
+	cm.snapshotPending = true
+	cm.commitIndex = args.LastIncludedIndex
+	if err := cm.persistSnapshot(); err != nil {
+		cm.fail(err)
+		return err
+	}
+	cm.debug("... InstallSnapshot: installed, log=%v", cm.log)
+	cm.notifyCommitReady()
+	return nil
+}
+
+// Snapshot informs the ConsensusModule that the application has taken a
+// snapshot of its state covering all entries up to and including index.
+// The log prefix up to index is discarded, and the snapshot is sent to
+// followers that have fallen behind it.
+func (cm *ConsensusModule) Snapshot(index int, snapshot []byte) error {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	if cm.isFailed() {
+		return cm.err
+	}
+	if index > cm.lastApplied {
+		return fmt.Errorf("snapshot index %d is beyond lastApplied %d", index, cm.lastApplied)
+	}
+	if index <= cm.lastIncludedIndex {
+		return nil
+	}
+	cm.debug("Snapshot: compacting log through index %d", index)
+	cm.lastIncludedTerm = cm.termAt(index)
+	cm.snapshotConfiguration, _ = cm.configurationAt(index)
+	cm.log = append([]LogEntry(nil), cm.log[cm.logPos(index)+1:]...)
+	cm.lastIncludedIndex = index
+	cm.snapshot = snapshot
+	if err := cm.persistSnapshot(); err != nil {
+		cm.fail(err)
+		return err
+	}
+	return nil
+}
+
+// electionTimeout draws an election timeout. Expects cm.mu to be locked.
 func (cm *ConsensusModule) electionTimeout() time.Duration {
-	return time.Duration(rand.Intn(ElectionTimeoutMax-ElectionTimeoutMin)+ElectionTimeoutMin) * TimeoutUnit
+	spread := cm.config.ElectionTimeoutMax - cm.config.ElectionTimeoutMin
+	return cm.config.ElectionTimeoutMin + time.Duration(cm.rand.Int63n(int64(spread)))
 }
 
 func (cm *ConsensusModule) NewHeartbeatTicker() *time.Ticker {
-	return time.NewTicker(HeartbeatTimeout * TimeoutUnit)
+	return time.NewTicker(cm.config.HeartbeatInterval)
 }
 
 func (cm *ConsensusModule) heartbeatTimeout() time.Duration {
-	return time.Duration(HeartbeatTimeout) * TimeoutUnit
+	return cm.config.HeartbeatInterval
 }
 
 func (cm *ConsensusModule) isLeader() bool {
@@ -284,16 +679,38 @@ func (cm *ConsensusModule) isDead() bool {
 	return cm.state == Dead
 }
 
+func (cm *ConsensusModule) isFailed() bool {
+	return cm.state == Failed
+}
+
+// leaderAlive reports whether this server is the leader, or heard from one
+// within the minimum election timeout.
+func (cm *ConsensusModule) leaderAlive() bool {
+	return cm.isLeader() || time.Since(cm.leaderContactTime) < cm.config.ElectionTimeoutMin
+}
+
 func (cm *ConsensusModule) Stop() {
 	cm.mu.Lock()
 	defer cm.mu.Unlock()
+	if cm.isDead() {
+		return
+	}
 	cm.state = Dead
 	cm.debug("becomes Dead")
+	cm.stopReplication()
+	if cm.configChangeDone != nil {
+		cm.configChangeDone <- ErrStopped
+		cm.configChangeDone = nil
+	}
+	cm.abortTransfer(ErrStopped)
+	cm.resolveProposalsFrom(0, ErrStopped)
+	// Let the applier finish.
+	close(cm.newCommitReadyChan)
 }
 
 func (cm *ConsensusModule) runElectionTimer() {
-	electionTimeout := cm.electionTimeout()
 	cm.mu.Lock()
+	electionTimeout := cm.electionTimeout()
 	termStarted := cm.currentTerm
 	cm.mu.Unlock()
 	cm.debug("election timer started (%v), term (%d)", electionTimeout, termStarted)
@@ -317,7 +734,18 @@ func (cm *ConsensusModule) runElectionTimer() {
 		}
 
 		if elapsed := time.Since(cm.electionResetTime); elapsed >= electionTimeout {
-			cm.startElection()
+			if !cm.configuration.isVoter(cm.id) {
+				// Servers outside the configuration never campaign; they wait to be
+				// added, or for the leader to stop contacting them.
+				cm.electionResetTime = time.Now()
+				cm.mu.Unlock()
+				continue
+			}
+			if cm.config.PreVote {
+				cm.startPreVote()
+			} else {
+				cm.startElection(false)
+			}
 			cm.mu.Unlock()
 			return
 		}
@@ -325,31 +753,37 @@ func (cm *ConsensusModule) runElectionTimer() {
 	}
 }
 
-func (cm *ConsensusModule) startElection() {
+func (cm *ConsensusModule) startElection(leadershipTransfer bool) {
 	cm.state = Candidate
 	cm.currentTerm += 1
 	preCurrentTerm := cm.currentTerm
 	cm.votedFor = cm.id
+	cm.leaderId = -1
 	cm.electionResetTime = time.Now()
 	cm.debug("becomes Candidate (currentTerm=%d)", cm.currentTerm)
+	if err := cm.persistHardState(); err != nil {
+		cm.fail(err)
+		return
+	}
 
-	votesReceived := 1
+	votesReceived := map[int]bool{cm.id: true}
 
-	for _, peerId := range cm.peerIds {
+	for _, peerId := range cm.peers() {
 		go func(peerId int) {
 			cm.mu.Lock()
 			savedLastLogIndex, savedLastLogTerm := cm.lastLogIndexAndTerm()
 			cm.mu.Unlock()
 
 			args := RequestVoteArgs{
-				Term:         preCurrentTerm,
-				CandidateId:  cm.id,
-				LastLogIndex: savedLastLogIndex,
-				LastLogTerm:  savedLastLogTerm,
+				Term:               preCurrentTerm,
+				CandidateId:        cm.id,
+				LastLogIndex:       savedLastLogIndex,
+				LastLogTerm:        savedLastLogTerm,
+				LeadershipTransfer: leadershipTransfer,
 			}
 			var reply RequestVoteReply
 			cm.debug("sending RequestVote to %d: %+v", peerId, args)
-			err := cm.server.Call(peerId, "ConsensusModule.RequestVote", args, &reply)
+			err := cm.transport.RequestVote(peerId, args, &reply)
 			if err == nil {
 				cm.mu.Lock()
 				defer cm.mu.Unlock()
@@ -364,9 +798,9 @@ func (cm *ConsensusModule) startElection() {
 					return
 				}
 				if reply.Term == preCurrentTerm && reply.VoteGranted {
-					votesReceived += 1
-					if votesReceived*2 > len(cm.peerIds)+1 {
-						cm.debug("wins election with %d votes", votesReceived)
+					votesReceived[peerId] = true
+					if cm.configuration.hasQuorum(func(id int) bool { return votesReceived[id] }) {
+						cm.debug("wins election with %d votes", len(votesReceived))
 						cm.startLeader()
 						return
 					}
@@ -378,12 +812,27 @@ func (cm *ConsensusModule) startElection() {
 	go cm.runElectionTimer()
 }
 
+// becomeFollower moves to term, which must be no earlier than the current
+// one, as a follower. A server stepping down within its term keeps the vote
+// it cast in it, so that it can't vote twice.
 func (cm *ConsensusModule) becomeFollower(term int) {
+	if cm.isFailed() || cm.isDead() {
+		return
+	}
 	cm.debug("becomes Follower term=(%d)", term)
 	cm.state = Follower
-	cm.currentTerm = term
-	cm.votedFor = -1
+	if term > cm.currentTerm {
+		cm.currentTerm = term
+		cm.votedFor = -1
+	}
+	cm.leaderId = -1
 	cm.electionResetTime = time.Now()
+	cm.leaseExpiry = time.Time{}
+	cm.stopReplication()
+	if cm.configChangeDone != nil {
+		cm.configChangeDone <- ErrLeadershipLost
+		cm.configChangeDone = nil
+	}
 
 	go cm.runElectionTimer()
 }
@@ -391,11 +840,23 @@ func (cm *ConsensusModule) becomeFollower(term int) {
 func (cm *ConsensusModule) startLeader() {
 	cm.debug("becomes Leader (currentTerm=%d)", cm.currentTerm)
 	cm.state = Leader
-
-	for _, peerId := range cm.peerIds {
-		cm.nextIndex[peerId] = len(cm.log)
+	cm.leaderId = cm.id
+	// Leadership came back here before the transfer target took it.
+	cm.abortTransfer(ErrLeadershipLost)
+
+	cm.ackTime = make(map[int]time.Time)
+	cm.leaderStartTime = time.Now()
+	cm.leaseExpiry = time.Time{}
+	for _, peerId := range cm.peers() {
+		cm.nextIndex[peerId] = cm.logLen()
 		cm.matchIndex[peerId] = -1
 	}
+	// A leader only counts replicas of entries from its own term to commit,
+	// so commit one straight away, taking the earlier ones with it.
+	if err := cm.appendLog(LogEntry{Term: cm.currentTerm, Type: EntryNoop}); err != nil {
+		cm.fail(err)
+		return
+	}
 	cm.debug("becomes Leader (term=%d, nextIndex=%v, matchIndex=%v), (log=%v)", cm.currentTerm, cm.nextIndex, cm.matchIndex, cm.log)
 
 	go func(hearbeatTimeout time.Duration) {
@@ -428,230 +889,172 @@ func (cm *ConsensusModule) startLeader() {
 					cm.mu.Unlock()
 					return
 				}
+				if !cm.quorumActive() {
+					cm.debug("lost contact with a quorum, stepping down")
+					cm.becomeFollower(cm.currentTerm)
+					cm.mu.Unlock()
+					return
+				}
 				cm.mu.Unlock()
 				cm.leaderSendAEs()
 			}
 		}
-		// old leaderHeartbeats
-		//ticker := cm.NewHeartbeatTicker()
-		//defer ticker.Stop()
-		//
-		//for {
-		//	cm.leaderHeartbeats()
-		//	<-ticker.C
-		//
-		//	cm.mu.Lock()
-		//	if !cm.isLeader() {
-		//		cm.mu.Unlock()
-		//		return
-		//	}
-		//	cm.mu.Unlock()
-		//}
 	}(cm.heartbeatTimeout())
 }
 
-func (cm *ConsensusModule) leaderHeartbeats() {
-	cm.mu.Lock()
-	if !cm.isLeader() {
-		cm.mu.Unlock()
-		return
-	}
-	savedCurrentTerm := cm.currentTerm
-	cm.mu.Unlock()
-
-	for _, peerId := range cm.peerIds {
-		go func(peerId int) {
-			cm.mu.Lock()
-			ni := cm.nextIndex[peerId]
-			prevLogIndex := ni - 1
-			prevLogTerm := -1
-			if prevLogIndex >= 0 {
-				prevLogTerm = cm.log[prevLogIndex].Term
-			}
-			entries := cm.log[ni:]
-			args := AppendEntriesArgs{
-				Term:         savedCurrentTerm,
-				LeaderId:     cm.id,
-				PrevLogIndex: prevLogIndex,
-				PrevLogTerm:  prevLogTerm,
-				Entries:      entries,
-				LeaderCommit: cm.commitIndex,
-			}
-			cm.mu.Unlock()
-
-			var reply AppendEntriesReply
-			cm.debug("sending AppendEntries to %d: %+v", peerId, args)
-			err := cm.server.Call(peerId, "ConsensusModule.AppendEntries", args, &reply)
-			if err == nil {
-				cm.mu.Lock()
-				defer cm.mu.Unlock()
-				cm.debug("received AppendEntriesReply %+v", reply)
-				//if !cm.isLeader() {
-				//	cm.debug("while waiting for reply, state = %s", cm.state)
-				//	return
-				//}
-				if reply.Term > savedCurrentTerm {
-					cm.debug("term out of date in AppendEntriesReply")
-					cm.becomeFollower(reply.Term)
-					return
-				}
-
-				if cm.isLeader() && savedCurrentTerm == reply.Term {
-					if reply.Success {
-						cm.nextIndex[peerId] = ni + len(entries)
-						cm.matchIndex[peerId] = cm.nextIndex[peerId] - 1
-						cm.debug("AppendEntries reply from %d success: nextIndex := %d, matchIndex := %d", peerId, cm.nextIndex[peerId], cm.matchIndex[peerId])
-
-						savedCommitIndex := cm.commitIndex
-						for i := cm.commitIndex + 1; i < len(cm.log); i++ {
-							if cm.log[i].Term == cm.currentTerm {
-								matchCount := 1
-								for _, peerId := range cm.peerIds {
-									if cm.matchIndex[peerId] >= i {
-										matchCount += 1
-									}
-								}
-								if matchCount*2 > len(cm.peerIds)+1 {
-									cm.commitIndex = i
-								}
-							}
-						}
-						if cm.commitIndex != savedCommitIndex {
-							cm.debug("leader sets commitIndex := %d", cm.commitIndex)
-							cm.newCommitReadyChan <- struct{}{}
-							cm.triggerAEChan <- struct{}{}
-						}
-					} else {
-						cm.nextIndex[peerId] = ni - 1
-						cm.debug("AppendEntries reply from %d !success: decrement nextIndex to %d", peerId, cm.nextIndex[peerId])
-					}
-				}
-			}
-		}(peerId)
-	}
-}
-
-func (cm *ConsensusModule) commitChanSender() {
+// applier applies committed entries, and snapshots to restore, to the FSM in
+// log order.
+func (cm *ConsensusModule) applier() {
 	for range cm.newCommitReadyChan {
 		cm.mu.Lock()
-		savedTerm := cm.currentTerm
+		var snapshot *CommitEntry
+		if cm.snapshotPending {
+			snapshot = &CommitEntry{
+				Index:    cm.lastIncludedIndex,
+				Term:     cm.lastIncludedTerm,
+				Snapshot: cm.snapshot,
+			}
+			cm.snapshotPending = false
+			cm.lastApplied = cm.lastIncludedIndex
+		}
 		savedLastApplied := cm.lastApplied
+		commitIndex := cm.commitIndex
 		var entries []LogEntry
-		if cm.commitIndex > cm.lastApplied {
-			entries = cm.log[cm.lastApplied+1 : cm.commitIndex+1]
-			cm.lastApplied = cm.commitIndex
+		if commitIndex > cm.lastApplied {
+			entries = cm.log[cm.logPos(cm.lastApplied+1):cm.logPos(commitIndex+1)]
+			cm.lastApplied = commitIndex
 		}
 		cm.mu.Unlock()
-		cm.debug("commitChanSender: lastApplied := %d, commitIndex := %d, entries=%v", savedLastApplied, cm.commitIndex, entries)
+		cm.debug("applier: lastApplied := %d, commitIndex := %d, entries=%v", savedLastApplied, commitIndex, entries)
 
+		cm.applyMu.Lock()
+		fsmApplied := cm.fsmApplied
+		if snapshot != nil {
+			if err := cm.restoreFSM(*snapshot); err != nil {
+				cm.applyMu.Unlock()
+				cm.mu.Lock()
+				cm.fail(fmt.Errorf("restore snapshot at index %d: %w", snapshot.Index, err))
+				cm.mu.Unlock()
+				continue
+			}
+			fsmApplied = snapshot.Index
+		}
+		results := make([]interface{}, len(entries))
 		for i, entry := range entries {
-			cm.commitChan <- CommitEntry{
-				Index:   savedLastApplied + i + 1,
-				Term:    savedTerm,
+			index := savedLastApplied + i + 1
+			commit := CommitEntry{
+				Index:   index,
+				Term:    entry.Term,
+				Type:    entry.Type,
 				Command: entry.Command,
+				Data:    entry.Data,
+				IsData:  entry.IsData,
+			}
+			if commit.IsData && commit.Data == nil {
+				commit.Data = []byte{}
+			}
+			results[i] = cm.applyEntry(commit)
+			fsmApplied = index
+		}
+
+		cm.mu.Lock()
+		cm.fsmApplied = fsmApplied
+		cm.applyMu.Unlock()
+		if snapshot != nil {
+			for index := range cm.proposals {
+				if index <= snapshot.Index {
+					cm.resolveProposal(index, nil, nil)
+				}
 			}
 		}
+		for i, entry := range entries {
+			cm.applied(savedLastApplied+i+1, entry.Term, results[i])
+		}
+		cm.mu.Unlock()
+	}
+	cm.debug("applier done")
+}
+
+// applyEntry hands a committed command to the FSM, returning its result.
+// Entries of the other types took effect when they were appended or
+// committed, so applying them does nothing. Expects cm.applyMu to be locked.
+func (cm *ConsensusModule) applyEntry(entry CommitEntry) interface{} {
+	switch entry.Type {
+	case EntryCommand:
+		return cm.fsm.Apply(entry)
+	case EntryConfiguration:
+		cm.debug("applier: configuration %+v at index %d", entry.Command, entry.Index)
+	}
+	return nil
+}
+
+// notifyCommitReady tells the applier there are new entries to apply, or a
+// snapshot to restore. It never blocks: a notification that is already
+// pending covers this one too, as the applier catches up with everything
+// committed when it takes it. Expects cm.mu to be locked.
+func (cm *ConsensusModule) notifyCommitReady() {
+	if cm.isDead() {
+		return
+	}
+	select {
+	case cm.newCommitReadyChan <- struct{}{}:
+	default:
+	}
+}
+
+// triggerAE asks the leader loop to send AppendEntries now. It never blocks:
+// a trigger that is already pending covers this one too, and there may be no
+// leader loop left to receive it.
+func (cm *ConsensusModule) triggerAE() {
+	select {
+	case cm.triggerAEChan <- struct{}{}:
+	default:
 	}
-	cm.debug("commitChanSender done")
 }
 
 func (cm *ConsensusModule) lastLogIndexAndTerm() (int, int) {
 	if len(cm.log) > 0 {
-		lastLogIndex := len(cm.log) - 1
-		return lastLogIndex, cm.log[lastLogIndex].Term
+		lastLogIndex := cm.logLen() - 1
+		return lastLogIndex, cm.log[len(cm.log)-1].Term
 	}
-	return -1, -1
+	return cm.lastIncludedIndex, cm.lastIncludedTerm
 }
 
-func (cm *ConsensusModule) leaderSendAEs() {
-	cm.mu.Lock()
-	if cm.state != Leader {
-		cm.mu.Unlock()
-		return
+// logLen returns the index one past the last entry in the log, counting the
+// entries compacted into the snapshot.
+func (cm *ConsensusModule) logLen() int {
+	return cm.lastIncludedIndex + 1 + len(cm.log)
+}
+
+// logPos maps a log index to its position in cm.log.
+func (cm *ConsensusModule) logPos(index int) int {
+	return index - cm.lastIncludedIndex - 1
+}
+
+func (cm *ConsensusModule) termAt(index int) int {
+	if index == cm.lastIncludedIndex {
+		return cm.lastIncludedTerm
 	}
-	savedCurrentTerm := cm.currentTerm
-	cm.mu.Unlock()
+	return cm.log[cm.logPos(index)].Term
+}
 
-	for _, peerId := range cm.peerIds {
-		go func(peerId int) {
-			cm.mu.Lock()
-			ni := cm.nextIndex[peerId]
-			prevLogIndex := ni - 1
-			prevLogTerm := -1
-			if prevLogIndex >= 0 {
-				prevLogTerm = cm.log[prevLogIndex].Term
-			}
-			entries := cm.log[ni:]
-
-			args := AppendEntriesArgs{
-				Term:         savedCurrentTerm,
-				LeaderId:     cm.id,
-				PrevLogIndex: prevLogIndex,
-				PrevLogTerm:  prevLogTerm,
-				Entries:      entries,
-				LeaderCommit: cm.commitIndex,
-			}
-			cm.mu.Unlock()
-			cm.debug("sending AppendEntries to %v: ni=%d, args=%+v", peerId, ni, args)
-			var reply AppendEntriesReply
-			if err := cm.server.Call(peerId, "ConsensusModule.AppendEntries", args, &reply); err == nil {
-				cm.mu.Lock()
-				defer cm.mu.Unlock()
-				if reply.Term > cm.currentTerm {
-					cm.debug("term out of date in heartbeat reply")
-					cm.becomeFollower(reply.Term)
-					return
-				}
+// recordAck notes that peerId answered a request the leader sent at sentAt.
+// Expects cm.mu to be locked.
+func (cm *ConsensusModule) recordAck(peerId int, sentAt time.Time) {
+	if sentAt.After(cm.ackTime[peerId]) {
+		cm.ackTime[peerId] = sentAt
+		cm.extendLease()
+	}
+}
 
-				if cm.state == Leader && savedCurrentTerm == reply.Term {
-					if reply.Success {
-						cm.nextIndex[peerId] = ni + len(entries)
-						cm.matchIndex[peerId] = cm.nextIndex[peerId] - 1
-
-						savedCommitIndex := cm.commitIndex
-						for i := cm.commitIndex + 1; i < len(cm.log); i++ {
-							if cm.log[i].Term == cm.currentTerm {
-								matchCount := 1
-								for _, peerId := range cm.peerIds {
-									if cm.matchIndex[peerId] >= i {
-										matchCount++
-									}
-								}
-								if matchCount*2 > len(cm.peerIds)+1 {
-									cm.commitIndex = i
-								}
-							}
-						}
-						cm.debug("AppendEntries reply from %d success: nextIndex := %v, matchIndex := %v; commitIndex := %d", peerId, cm.nextIndex, cm.matchIndex, cm.commitIndex)
-						if cm.commitIndex != savedCommitIndex {
-							cm.debug("leader sets commitIndex := %d", cm.commitIndex)
-							// Commit index changed: the leader considers new entries to be
-							// committed. Send new entries on the commit channel to this
-							// leader's clients, and notify followers by sending them AEs.
-							cm.newCommitReadyChan <- struct{}{}
-							cm.triggerAEChan <- struct{}{}
-						}
-					} else {
-						if reply.ConflictTerm >= 0 {
-							lastIndexOfTerm := -1
-							for i := len(cm.log) - 1; i >= 0; i-- {
-								if cm.log[i].Term == reply.ConflictTerm {
-									lastIndexOfTerm = i
-									break
-								}
-							}
-							if lastIndexOfTerm >= 0 {
-								cm.nextIndex[peerId] = lastIndexOfTerm + 1
-							} else {
-								cm.nextIndex[peerId] = reply.ConflictIndex
-							}
-						} else {
-							cm.nextIndex[peerId] = reply.ConflictIndex
-						}
-						cm.debug("AppendEntries reply from %d !success: nextIndex := %d", peerId, ni-1)
-					}
-				}
-			}
-		}(peerId)
+// quorumActive reports whether the leader has heard from a quorum within an
+// election timeout, allowing a newly elected leader one election timeout to
+// do so. Expects cm.mu to be locked.
+func (cm *ConsensusModule) quorumActive() bool {
+	if time.Since(cm.leaderStartTime) < cm.config.ElectionTimeoutMax {
+		return true
 	}
+	return cm.configuration.hasQuorum(func(id int) bool {
+		return id == cm.id || time.Since(cm.ackTime[id]) < cm.config.ElectionTimeoutMax
+	})
 }
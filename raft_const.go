@@ -7,6 +7,8 @@ const (
 	HeartbeatTimeout                 = 50
 	ElectionTimeoutMin               = 150
 	ElectionTimeoutMax               = 300
+	ForwardTimeout                   = 1000
+	AppendBatchDelay                 = 1
 	MockUnreliableRpcFailureDuration = 120
 	MockUnreliableRpcDelayMin        = 60
 	MockUnreliableRpcDelayMax        = 70
@@ -26,6 +28,7 @@ const (
 	Candidate
 	Leader
 	Dead
+	Failed
 )
 
 func (s CMState) String() string {
@@ -38,6 +41,8 @@ func (s CMState) String() string {
 		return "Leader"
 	case Dead:
 		return "Dead"
+	case Failed:
+		return "Failed"
 	default:
 		panic("invalid state")
 	}
@@ -1,6 +1,13 @@
 package raft
 
-import "testing"
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
 
 func TestElectionBasic(t *testing.T) {
 	h := NewHarness(t, 5)
@@ -8,3 +15,869 @@ func TestElectionBasic(t *testing.T) {
 
 	h.CheckSingleLeader()
 }
+
+func TestSnapshotInstallToLaggingFollower(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	origLeaderId, _ := h.CheckSingleLeader()
+	otherId := (origLeaderId + 1) % 3
+	h.DisconnectPeer(otherId)
+
+	for i := 0; i < 10; i++ {
+		h.SubmitToServer(origLeaderId, 100+i)
+	}
+	sleepMs(500)
+	h.CheckCommittedN(109, 2)
+
+	snapshotIndex := -1
+	for i := 0; i < 3; i++ {
+		if i == otherId {
+			continue
+		}
+		last, ok := h.LastCommit(i)
+		if !ok {
+			t.Fatalf("server %d has no commits", i)
+		}
+		if err := h.cluster[i].cm.Snapshot(last.Index, []byte("snapshot")); err != nil {
+			t.Fatal(err)
+		}
+		snapshotIndex = last.Index
+	}
+
+	h.ReconnectPeer(otherId)
+	sleepMs(1000)
+	newLeaderId, _ := h.CheckSingleLeader()
+	h.SubmitToServer(newLeaderId, 110)
+	sleepMs(500)
+
+	h.mu.Lock()
+	var gotSnapshot bool
+	for _, c := range h.commits[otherId] {
+		if c.Snapshot != nil {
+			gotSnapshot = true
+			if string(c.Snapshot) != "snapshot" || c.Index != snapshotIndex {
+				t.Errorf("got snapshot %q at index %d, want %q at %d", c.Snapshot, c.Index, "snapshot", snapshotIndex)
+			}
+		}
+	}
+	h.mu.Unlock()
+	if !gotSnapshot {
+		t.Errorf("server %d did not receive a snapshot", otherId)
+	}
+	h.CheckCommittedN(110, 3)
+}
+
+func TestMembershipAddAndRemoveServer(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+	h.SetReliable(true)
+
+	origLeaderId, _ := h.CheckSingleLeader()
+	h.SubmitToServer(origLeaderId, 5)
+	h.SubmitToServer(origLeaderId, 6)
+	sleepMs(300)
+	h.CheckCommittedN(6, 3)
+
+	newId, err := h.AddServer(origLeaderId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sleepMs(300)
+	h.CheckCommittedN(6, 4)
+
+	if err := h.cluster[origLeaderId].RemoveServer(origLeaderId); err != nil {
+		t.Fatal(err)
+	}
+	sleepMs(1000)
+
+	newLeaderId, _ := h.CheckSingleLeader()
+	if newLeaderId == origLeaderId {
+		t.Fatalf("removed server %d is still leader", origLeaderId)
+	}
+	h.SubmitToServer(newLeaderId, 7)
+	sleepMs(500)
+	h.CheckCommittedN(7, 3)
+
+	h.cluster[newId].cm.mu.Lock()
+	voters := h.cluster[newId].cm.configuration.Voters
+	h.cluster[newId].cm.mu.Unlock()
+	if containsId(voters, origLeaderId) || !containsId(voters, newId) || len(voters) != 3 {
+		t.Errorf("got voters %v on server %d", voters, newId)
+	}
+}
+
+// A configuration change still waiting to commit when the leader stops
+// returns ErrStopped.
+func TestMembershipChangeReturnsOnStop(t *testing.T) {
+	network := NewInmemNetwork()
+	cms, _, stop := startInmemCluster(t, network, 3, DefaultConfig())
+	defer stop()
+
+	leaderId := waitForLeader(cms)
+	if leaderId < 0 {
+		t.Fatalf("no leader elected")
+	}
+	network.Disconnect(leaderId)
+	done := make(chan error, 1)
+	go func() {
+		done <- cms[leaderId].AddServer(3)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	cms[leaderId].Stop()
+
+	select {
+	case err := <-done:
+		if err != ErrStopped {
+			t.Errorf("got err %v, want %v", err, ErrStopped)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("AddServer blocked after Stop")
+	}
+}
+
+func TestTransferLeadership(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	origLeaderId, origTerm := h.CheckSingleLeader()
+	h.SubmitToServer(origLeaderId, 5)
+	sleepMs(300)
+
+	targetId := (origLeaderId + 1) % 3
+	var err error
+	for r := 0; r < 3; r++ {
+		if err = h.cluster[origLeaderId].cm.TransferLeadership(targetId); err != ErrTransferTimeout {
+			break
+		}
+	}
+	if err == ErrLeadershipLost {
+		// A dropped TimeoutNow or vote can let another server win the election.
+		t.Skipf("leadership went to a server other than %d", targetId)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	sleepMs(300)
+
+	newLeaderId, newTerm := h.CheckSingleLeader()
+	if newLeaderId != targetId {
+		t.Errorf("got leader %d, want %d", newLeaderId, targetId)
+	}
+	if newTerm <= origTerm {
+		t.Errorf("got term %d, want > %d", newTerm, origTerm)
+	}
+	if h.SubmitToServer(origLeaderId, 6) {
+		t.Errorf("old leader %d accepted Submit", origLeaderId)
+	}
+}
+
+func TestTransferLeadershipTimeout(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	origLeaderId, _ := h.CheckSingleLeader()
+	targetId := (origLeaderId + 1) % 3
+	h.DisconnectPeer(targetId)
+
+	if err := h.cluster[origLeaderId].cm.TransferLeadership(targetId); err != ErrTransferTimeout {
+		t.Fatalf("got err %v, want %v", err, ErrTransferTimeout)
+	}
+	if !h.SubmitToServer(origLeaderId, 5) {
+		t.Errorf("leader %d refused Submit after an aborted transfer", origLeaderId)
+	}
+}
+
+func TestTransferLeadershipLostToOtherServer(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	origLeaderId, origTerm := h.CheckSingleLeader()
+	targetId := (origLeaderId + 1) % 3
+	otherId := (origLeaderId + 2) % 3
+	h.DisconnectPeer(targetId)
+
+	cm := h.cluster[origLeaderId].cm
+	done := make(chan error, 1)
+	go func() { done <- cm.TransferLeadership(targetId) }()
+	for deadline := time.Now().Add(time.Second); ; {
+		cm.mu.Lock()
+		pending := cm.transferDone != nil
+		cm.mu.Unlock()
+		if pending {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("transfer to %d did not start", targetId)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// The leader hears from another server that won a later term.
+	var reply AppendEntriesReply
+	if err := cm.AppendEntries(AppendEntriesArgs{Term: origTerm + 1, LeaderId: otherId, PrevLogIndex: -1, PrevLogTerm: -1, LeaderCommit: -1}, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != ErrLeadershipLost {
+		t.Errorf("got err %v, want %v", err, ErrLeadershipLost)
+	}
+}
+
+func TestPreVoteDisconnectedFollowerDoesNotDisrupt(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+	for i := 0; i < 3; i++ {
+		h.cluster[i].cm.SetPreVote(true)
+	}
+
+	origLeaderId, origTerm := h.CheckSingleLeader()
+	otherId := (origLeaderId + 1) % 3
+	h.DisconnectPeer(otherId)
+	sleepMs(1000)
+
+	if _, term, _, _ := h.cluster[otherId].cm.Report(); term != origTerm {
+		t.Errorf("disconnected server %d moved to term %d, want %d", otherId, term, origTerm)
+	}
+
+	h.ReconnectPeer(otherId)
+	sleepMs(500)
+	newLeaderId, newTerm := h.CheckSingleLeader()
+	if newLeaderId != origLeaderId || newTerm != origTerm {
+		t.Errorf("got leader %d in term %d, want %d in term %d", newLeaderId, newTerm, origLeaderId, origTerm)
+	}
+}
+
+func TestCheckQuorumLeaderStepsDown(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	origLeaderId, _ := h.CheckSingleLeader()
+	h.DisconnectPeer(origLeaderId)
+	sleepMs(600)
+
+	if _, _, isLeader, _ := h.cluster[origLeaderId].cm.Report(); isLeader {
+		t.Errorf("partitioned server %d still reports it is leader", origLeaderId)
+	}
+	if h.SubmitToServer(origLeaderId, 5) {
+		t.Errorf("partitioned server %d accepted Submit", origLeaderId)
+	}
+	newLeaderId, _ := h.CheckSingleLeader()
+	if newLeaderId == origLeaderId {
+		t.Errorf("got leader %d, want a different one", newLeaderId)
+	}
+}
+
+// A leader that steps down on losing its quorum keeps its vote for itself, so
+// a late candidate of the same term can't get a second one from it.
+func TestCheckQuorumStepDownKeepsVote(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	origLeaderId, _ := h.CheckSingleLeader()
+	h.DisconnectPeer(origLeaderId)
+	cm := h.cluster[origLeaderId].cm
+	var term int
+	for deadline := time.Now().Add(2 * time.Second); ; {
+		var isLeader bool
+		if _, term, isLeader, _ = cm.Report(); !isLeader {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("partitioned server %d did not step down", origLeaderId)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	candidateId := (origLeaderId + 1) % 3
+	var reply RequestVoteReply
+	if err := cm.RequestVote(RequestVoteArgs{Term: term, CandidateId: candidateId, LastLogIndex: 1000, LastLogTerm: term}, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.VoteGranted {
+		t.Errorf("server %d granted a second vote in term %d", origLeaderId, term)
+	}
+}
+
+func TestReadIndex(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	origLeaderId, _ := h.CheckSingleLeader()
+	h.SubmitToServer(origLeaderId, 5)
+	h.SubmitToServer(origLeaderId, 6)
+	sleepMs(300)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	readIndex, err := h.cluster[origLeaderId].cm.ReadIndex(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if readIndex < 1 {
+		t.Errorf("got readIndex %d, want >= 1", readIndex)
+	}
+
+	followerId := (origLeaderId + 1) % 3
+	if _, err := h.cluster[followerId].cm.ReadIndex(ctx); err != ErrNotLeader {
+		t.Errorf("got err %v on follower, want %v", err, ErrNotLeader)
+	}
+
+	h.DisconnectPeer(origLeaderId)
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := h.cluster[origLeaderId].cm.ReadIndex(ctx); err == nil {
+		t.Errorf("partitioned leader %d served ReadIndex", origLeaderId)
+	}
+}
+
+// slowFSM takes a while to apply each entry, and records the index of the
+// last one it applied.
+type slowFSM struct {
+	counterFSM
+	index atomic.Int64
+}
+
+func (f *slowFSM) Apply(entry CommitEntry) interface{} {
+	time.Sleep(20 * time.Millisecond)
+	result := f.counterFSM.Apply(entry)
+	f.index.Store(int64(entry.Index))
+	return result
+}
+
+// ReadIndex returns only once the leader's FSM has applied the read index,
+// not as soon as the entries up to it are handed to the FSM.
+func TestReadIndexWaitsForFSM(t *testing.T) {
+	fsms := []*slowFSM{{}, {}, {}}
+	cms, stop := startInmemClusterWithFSMs(t, NewInmemNetwork(), DefaultConfig(), []FSM{fsms[0], fsms[1], fsms[2]})
+	defer stop()
+
+	leaderId := waitForLeader(cms)
+	if leaderId < 0 {
+		t.Fatalf("no leader elected")
+	}
+	cm := cms[leaderId]
+	var lastIndex int
+	for i := 0; i < 10; i++ {
+		lastIndex, _, _ = cm.Submit(1)
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		cm.mu.Lock()
+		committed := cm.commitIndex >= lastIndex
+		cm.mu.Unlock()
+		if committed {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("leader %d did not commit index %d", leaderId, lastIndex)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	readIndex, err := cm.ReadIndex(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if applied := int(fsms[leaderId].index.Load()); applied < readIndex {
+		t.Errorf("ReadIndex returned %d while the FSM had applied only up to %d", readIndex, applied)
+	}
+}
+
+func TestLeaseRead(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	origLeaderId, _ := h.CheckSingleLeader()
+	cm := h.cluster[origLeaderId].cm
+	if err := cm.SetLeaseRead(true, ElectionTimeoutMin*TimeoutUnit); err == nil {
+		t.Errorf("SetLeaseRead accepted a drift bound of a full election timeout")
+	}
+	for i := 0; i < 3; i++ {
+		if err := h.cluster[i].cm.SetLeaseRead(true, 10*time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h.SubmitToServer(origLeaderId, 5)
+
+	// A dropped heartbeat can leave the leader without a lease for a while,
+	// so wait for one to show up.
+	var leased bool
+	for deadline := time.Now().Add(2 * time.Second); !leased; {
+		if time.Now().After(deadline) {
+			t.Fatalf("leader %d holds no lease", origLeaderId)
+		}
+		time.Sleep(10 * time.Millisecond)
+		cm.mu.Lock()
+		leased = cm.hasLease()
+		cm.mu.Unlock()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := cm.ReadIndex(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	h.DisconnectPeer(origLeaderId)
+	sleepMs(ElectionTimeoutMin)
+	cm.mu.Lock()
+	leased = cm.hasLease()
+	cm.mu.Unlock()
+	if leased {
+		t.Errorf("partitioned leader %d still holds a lease", origLeaderId)
+	}
+}
+
+func TestFollowerIgnoresVotesOnlyWithLeaseRead(t *testing.T) {
+	for _, leaseRead := range []bool{false, true} {
+		config := DefaultConfig()
+		config.LeaseRead = leaseRead
+		cm, err := NewConsensusModule(0, []int{1, 2}, config, nil, make(chan interface{}), NewMapStorage(), NewChannelFSM(make(chan CommitEntry, 10)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var aeReply AppendEntriesReply
+		cm.AppendEntries(AppendEntriesArgs{Term: 1, LeaderId: 1, PrevLogIndex: -1, PrevLogTerm: -1}, &aeReply)
+		var rvReply RequestVoteReply
+		cm.RequestVote(RequestVoteArgs{Term: 2, CandidateId: 2, LastLogIndex: -1, LastLogTerm: -1}, &rvReply)
+		if rvReply.VoteGranted == leaseRead {
+			t.Errorf("LeaseRead=%v: got VoteGranted=%v while the leader is alive", leaseRead, rvReply.VoteGranted)
+		}
+		cm.Stop()
+	}
+}
+
+func TestLearnerNotCountedThenPromoted(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+	h.SetReliable(true)
+
+	origLeaderId, _ := h.CheckSingleLeader()
+	h.SubmitToServer(origLeaderId, 5)
+	sleepMs(300)
+
+	learnerId, err := h.AddLearner(origLeaderId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sleepMs(300)
+	h.CheckCommittedN(5, 4)
+
+	// With both followers gone, the leader and the learner are not a quorum.
+	follower1 := (origLeaderId + 1) % 3
+	follower2 := (origLeaderId + 2) % 3
+	h.DisconnectPeer(follower1)
+	h.DisconnectPeer(follower2)
+	h.SubmitToServer(origLeaderId, 6)
+	sleepMs(200)
+	h.CheckCommittedN(6, 0)
+
+	h.ReconnectPeer(follower1)
+	h.ReconnectPeer(follower2)
+	sleepMs(1000)
+	newLeaderId, _ := h.CheckSingleLeader()
+	h.SubmitToServer(newLeaderId, 7)
+	sleepMs(300)
+	h.CheckCommittedN(7, 4)
+
+	if err := h.cluster[newLeaderId].PromoteLearner(learnerId); err != nil {
+		t.Fatal(err)
+	}
+	sleepMs(300)
+	h.cluster[learnerId].cm.mu.Lock()
+	configuration := h.cluster[learnerId].cm.configuration
+	h.cluster[learnerId].cm.mu.Unlock()
+	if !containsId(configuration.Voters, learnerId) || len(configuration.Learners) != 0 {
+		t.Errorf("got configuration %+v on server %d", configuration, learnerId)
+	}
+}
+
+// failingStorage is a MapStorage whose writes fail once failing is set.
+type failingStorage struct {
+	*MapStorage
+	failing atomic.Bool
+}
+
+var errInjectedStorage = errors.New("injected storage failure")
+
+func (fs *failingStorage) Set(key string, value []byte) error {
+	if fs.failing.Load() {
+		return errInjectedStorage
+	}
+	return fs.MapStorage.Set(key, value)
+}
+
+func TestStorageFailureMovesToFailedState(t *testing.T) {
+	storage := &failingStorage{MapStorage: NewMapStorage()}
+	cm, err := NewConsensusModule(0, []int{1, 2}, DefaultConfig(), nil, make(chan interface{}), storage, NewChannelFSM(make(chan CommitEntry)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cm.Stop()
+
+	storage.failing.Store(true)
+	var rvReply RequestVoteReply
+	err = cm.RequestVote(RequestVoteArgs{Term: 5, CandidateId: 1, LastLogIndex: -1, LastLogTerm: -1}, &rvReply)
+	if !errors.Is(err, errInjectedStorage) {
+		t.Fatalf("got RequestVote err %v, want %v", err, errInjectedStorage)
+	}
+	if !errors.Is(cm.Err(), errInjectedStorage) {
+		t.Errorf("got Err() %v, want %v", cm.Err(), errInjectedStorage)
+	}
+
+	// A failed module refuses appends, even once storage works again.
+	storage.failing.Store(false)
+	var aeReply AppendEntriesReply
+	err = cm.AppendEntries(AppendEntriesArgs{Term: 5, LeaderId: 1, PrevLogIndex: -1, PrevLogTerm: -1}, &aeReply)
+	if err == nil || aeReply.Success {
+		t.Errorf("failed module accepted AppendEntries: err=%v, reply=%+v", err, aeReply)
+	}
+	cm.mu.Lock()
+	state := cm.state
+	cm.mu.Unlock()
+	if state != Failed {
+		t.Errorf("got state %v, want %v", state, Failed)
+	}
+}
+
+func TestHardStatePersistedOnlyOnChange(t *testing.T) {
+	storage := &failingStorage{MapStorage: NewMapStorage()}
+	cm, err := NewConsensusModule(0, []int{1, 2}, DefaultConfig(), nil, make(chan interface{}), storage, NewChannelFSM(make(chan CommitEntry)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cm.Stop()
+
+	heartbeat := AppendEntriesArgs{Term: 1, LeaderId: 1, PrevLogIndex: -1, PrevLogTerm: -1}
+	var reply AppendEntriesReply
+	if err := cm.AppendEntries(heartbeat, &reply); err != nil {
+		t.Fatal(err)
+	}
+
+	// Heartbeats of the same term write nothing, so they succeed even though
+	// storage fails.
+	storage.failing.Store(true)
+	for i := 0; i < 3; i++ {
+		if err := cm.AppendEntries(heartbeat, &reply); err != nil || !reply.Success {
+			t.Fatalf("heartbeat %d: err=%v, reply=%+v", i, err, reply)
+		}
+	}
+
+	heartbeat.Term = 2
+	if err := cm.AppendEntries(heartbeat, &reply); !errors.Is(err, errInjectedStorage) {
+		t.Errorf("got err %v for a new term, want %v", err, errInjectedStorage)
+	}
+}
+
+func TestCommitNotificationsDoNotBlock(t *testing.T) {
+	config := DefaultConfig()
+	config.CommitChanBuffer = 1
+	// Nobody reads the commit channel, so the applier blocks on the first
+	// entry.
+	cm, err := NewConsensusModule(0, []int{1, 2}, config, nil, make(chan interface{}), NewMapStorage(), NewChannelFSM(make(chan CommitEntry)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		prevLogTerm := -1
+		for i := 0; i < 5; i++ {
+			var reply AppendEntriesReply
+			cm.AppendEntries(AppendEntriesArgs{
+				Term:         1,
+				LeaderId:     1,
+				PrevLogIndex: i - 1,
+				PrevLogTerm:  prevLogTerm,
+				Entries:      []LogEntry{{Command: i, Term: 1}},
+				LeaderCommit: i,
+			}, &reply)
+			prevLogTerm = 1
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		// Stop would wait for the blocked AppendEntries.
+		t.Fatal("AppendEntries blocked on commit notifications")
+	}
+	cm.Stop()
+}
+
+func TestCorruptStorageFailsOnRestore(t *testing.T) {
+	storage := NewMapStorage()
+	storage.Set("hardState", []byte("garbage"))
+	cm, err := NewConsensusModule(0, []int{1, 2}, DefaultConfig(), nil, make(chan interface{}), storage, NewChannelFSM(make(chan CommitEntry)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cm.Stop()
+
+	if cm.Err() == nil {
+		t.Errorf("restoring from corrupt storage did not fail")
+	}
+}
+
+func TestRestoreFinishesInterruptedCompaction(t *testing.T) {
+	// A crash after persisting a snapshot, but before compacting the log,
+	// leaves the log store behind the snapshot.
+	storage := NewMapStorage()
+	ls, err := NewStorageLogStore(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ls.Append([]LogEntry{{Command: 0, Term: 1}, {Command: 1, Term: 1}, {Command: 2, Term: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	setGob(storage, "hardState", persistedHardState{CurrentTerm: 2, VotedFor: -1})
+	setGob(storage, "snapshot", persistedSnapshot{LastIncludedIndex: 4, LastIncludedTerm: 2, Data: []byte("snapshot")})
+
+	cm, err := NewConsensusModule(0, []int{1, 2}, DefaultConfig(), nil, make(chan interface{}), storage, NewChannelFSM(make(chan CommitEntry, 10)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cm.Stop()
+
+	if err := cm.Err(); err != nil {
+		t.Fatalf("restore failed: %v", err)
+	}
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if cm.logLen() != 5 || cm.logStore.FirstIndex() != 5 || cm.logStore.LastIndex() != 4 {
+		t.Errorf("got logLen=%d, log store first=%d last=%d; want 5, 5 and 4", cm.logLen(), cm.logStore.FirstIndex(), cm.logStore.LastIndex())
+	}
+}
+
+// A server that crashed after appending its first entries, but before
+// persisting a term, restarts in term 0 without a vote.
+func TestRestoreWithoutHardState(t *testing.T) {
+	storage := NewMapStorage()
+	ls, err := NewStorageLogStore(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ls.Append([]LogEntry{{Command: 0, Term: 1}}); err != nil {
+		t.Fatal(err)
+	}
+
+	cm, err := NewConsensusModule(0, []int{1, 2}, DefaultConfig(), nil, make(chan interface{}), storage, NewChannelFSM(make(chan CommitEntry, 10)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cm.Stop()
+
+	if err := cm.Err(); err != nil {
+		t.Fatalf("restore failed: %v", err)
+	}
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if cm.currentTerm != 0 || cm.votedFor != -1 || cm.logLen() != 1 {
+		t.Errorf("got term=%d votedFor=%d logLen=%d, want 0, -1 and 1", cm.currentTerm, cm.votedFor, cm.logLen())
+	}
+}
+
+func TestFollowerCommitStopsAtLastEntrySent(t *testing.T) {
+	cm, err := NewConsensusModule(0, []int{1, 2}, DefaultConfig(), nil, make(chan interface{}), NewMapStorage(), NewChannelFSM(make(chan CommitEntry, 10)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cm.Stop()
+
+	// The follower holds a stale entry at index 2 from a leader of term 1.
+	var reply AppendEntriesReply
+	cm.AppendEntries(AppendEntriesArgs{
+		Term:         1,
+		LeaderId:     1,
+		PrevLogIndex: -1,
+		PrevLogTerm:  -1,
+		Entries:      []LogEntry{{Command: 1, Term: 1}, {Command: 2, Term: 1}, {Command: 3, Term: 1}},
+		LeaderCommit: -1,
+	}, &reply)
+	if !reply.Success {
+		t.Fatalf("first AppendEntries failed: %+v", reply)
+	}
+
+	// The leader of term 2 has a different entry at index 2 and has committed
+	// up to index 3, but sends only the entry at index 1.
+	cm.AppendEntries(AppendEntriesArgs{
+		Term:         2,
+		LeaderId:     2,
+		PrevLogIndex: 0,
+		PrevLogTerm:  1,
+		Entries:      []LogEntry{{Command: 2, Term: 1}},
+		LeaderCommit: 3,
+	}, &reply)
+	if !reply.Success {
+		t.Fatalf("second AppendEntries failed: %+v", reply)
+	}
+
+	cm.mu.Lock()
+	commitIndex := cm.commitIndex
+	cm.mu.Unlock()
+	if commitIndex != 1 {
+		t.Errorf("got commitIndex %d, want 1", commitIndex)
+	}
+}
+
+func TestProposeAndWait(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	leaderId, _ := h.WaitForLeader(5 * time.Second)
+	followerId := (leaderId + 1) % 3
+	if _, _, err := h.cluster[followerId].cm.ProposeAndWait(context.Background(), 1); !errors.Is(err, ErrNotLeader) {
+		t.Errorf("follower ProposeAndWait got err %v, want %v", err, ErrNotLeader)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	index, _, err := h.cluster[leaderId].cm.ProposeAndWait(ctx, 2)
+	for errors.Is(err, ErrNotLeader) {
+		// Leadership moved on since we looked.
+		leaderId, _ = h.WaitForLeader(5 * time.Second)
+		index, _, err = h.cluster[leaderId].cm.ProposeAndWait(ctx, 2)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	sleepMs(50)
+	last, ok := h.LastCommit(leaderId)
+	if !ok || last.Index != index || last.Command != 2 {
+		t.Errorf("ProposeAndWait returned index %d, last commit is %+v", index, last)
+	}
+
+	// A proposal made by a partitioned leader is overwritten once it rejoins
+	// the cluster, which elected a new leader in the meantime.
+	h.DisconnectPeer(leaderId)
+	errc := make(chan error, 1)
+	go func() {
+		_, _, err := h.cluster[leaderId].cm.ProposeAndWait(ctx, 3)
+		errc <- err
+	}()
+	newLeaderId, _ := h.WaitForLeader(5 * time.Second)
+	h.SubmitToServer(newLeaderId, 4)
+	sleepMs(500)
+	h.ReconnectPeer(leaderId)
+
+	if err := <-errc; !errors.Is(err, ErrProposalDropped) {
+		t.Errorf("got err %v for the overwritten proposal, want %v", err, ErrProposalDropped)
+	}
+}
+
+func TestSubmitForwardedToLeader(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	leaderId, term := h.CheckSingleLeader()
+	followerId := (leaderId + 1) % 3
+	sleepMs(100)
+	if _, _, _, known := h.cluster[followerId].cm.Report(); known != leaderId {
+		t.Errorf("follower reports leader %d, want %d", known, leaderId)
+	}
+
+	index, submitTerm, err := h.Server(followerId).Submit(42)
+	if err != nil {
+		t.Fatalf("Submit on follower: %v", err)
+	}
+	if submitTerm != term {
+		t.Errorf("forwarded Submit got term %d, want %d", submitTerm, term)
+	}
+	h.WaitForCommittedN(42, 3, 2*time.Second)
+	if last, _ := h.LastCommit(followerId); last.Index != index {
+		t.Errorf("forwarded Submit got index %d, last commit is %+v", index, last)
+	}
+
+	// A follower cut off from the leader cannot forward.
+	h.DisconnectPeer(followerId)
+	if _, _, err := h.Server(followerId).Submit(43); err == nil {
+		t.Errorf("Submit on a disconnected follower succeeded")
+	}
+}
+
+// A new leader commits a no-op of its own term on election, so it can serve
+// reads without waiting for a client to submit something. The no-op never
+// reaches the FSM.
+func TestLeaderCommitsNoopOnElection(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	origLeaderId, _ := h.CheckSingleLeader()
+	h.SubmitToServer(origLeaderId, 1)
+	sleepMs(250)
+	h.DisconnectPeer(origLeaderId)
+	sleepMs(500)
+	newLeaderId, _ := h.CheckSingleLeader()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := h.cluster[newLeaderId].cm.ReadIndex(ctx); err != nil {
+		t.Errorf("ReadIndex on a new leader: %v", err)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, commits := range h.commits {
+		for _, c := range commits {
+			if c.Snapshot == nil && c.Command == nil {
+				t.Errorf("server %d applied a no-op at index %d", i, c.Index)
+			}
+		}
+	}
+}
+
+// An empty data command reaches every FSM as one, marked as data and with
+// non-nil Data, although gob decodes an empty slice as nil.
+func TestSubmitEmptyData(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	leaderId, _ := h.CheckSingleLeader()
+	if _, _, err := h.Server(leaderId).SubmitData([]byte{}); err != nil {
+		t.Fatal(err)
+	}
+	h.WaitForCommittedData([]byte{}, 3, 2*time.Second)
+
+	for i := 0; i < 3; i++ {
+		if last, ok := h.LastCommit(i); !ok || last.Command != nil {
+			t.Errorf("server %d last committed %+v, want an empty data command", i, last)
+		}
+	}
+}
+
+// Commands submitted as bytes reach every FSM as they were encoded, without
+// their type being registered with gob.
+func TestSubmitData(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	type point struct{ X, Y int }
+	encode := func(p point) []byte {
+		data, err := json.Marshal(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	leaderId, _ := h.CheckSingleLeader()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, _, err := h.cluster[leaderId].cm.ProposeData(ctx, encode(point{1, 2})); err != nil {
+		t.Fatal(err)
+	}
+	followerId := (leaderId + 1) % 3
+	if _, _, err := h.Server(followerId).SubmitData(encode(point{3, 4})); err != nil {
+		t.Fatalf("SubmitData on follower: %v", err)
+	}
+	h.WaitForCommittedData(encode(point{3, 4}), 3, 2*time.Second)
+
+	for i := 0; i < 3; i++ {
+		last, ok := h.LastCommit(i)
+		var p point
+		if !ok || last.Command != nil || json.Unmarshal(last.Data, &p) != nil || p != (point{3, 4}) {
+			t.Errorf("server %d last committed %+v, want %s", i, last, encode(point{3, 4}))
+		}
+	}
+}
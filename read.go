@@ -0,0 +1,129 @@
+package raft
+
+import (
+	"context"
+	"time"
+)
+
+// ReadIndex returns a log index such that a read of the application state
+// after applying all entries up to it is linearizable, without appending
+// anything to the log. It must be called on the leader: it records
+// commitIndex, confirms leadership with a round of heartbeats to a majority
+// and waits until the FSM has applied that index. With lease reads enabled the
+// heartbeat round is skipped while the leader holds a lease.
+func (cm *ConsensusModule) ReadIndex(ctx context.Context) (int, error) {
+	cm.mu.Lock()
+	if !cm.isLeader() {
+		cm.mu.Unlock()
+		return -1, ErrNotLeader
+	}
+	savedCurrentTerm := cm.currentTerm
+	cm.mu.Unlock()
+
+	// A new leader doesn't know the latest commit index until it has committed
+	// an entry of its own term.
+	var readIndex int
+	if err := cm.waitFor(ctx, savedCurrentTerm, func() bool {
+		readIndex = cm.commitIndex
+		return cm.termAt(cm.commitIndex) == cm.currentTerm
+	}); err != nil {
+		return -1, err
+	}
+
+	cm.mu.Lock()
+	leased := cm.hasLease()
+	cm.mu.Unlock()
+	if !leased {
+		start := time.Now()
+		cm.triggerAE()
+		if err := cm.waitFor(ctx, savedCurrentTerm, func() bool {
+			return cm.configuration.hasQuorum(func(id int) bool {
+				return id == cm.id || !cm.ackTime[id].Before(start)
+			})
+		}); err != nil {
+			return -1, err
+		}
+	}
+
+	if err := cm.waitFor(ctx, savedCurrentTerm, func() bool {
+		return cm.fsmApplied >= readIndex
+	}); err != nil {
+		return -1, err
+	}
+	cm.debug("ReadIndex: readIndex=%d, leased=%v", readIndex, leased)
+	return readIndex, nil
+}
+
+// waitFor polls cond with cm.mu locked until it returns true, failing if this
+// server stops being the leader of term or ctx is done.
+func (cm *ConsensusModule) waitFor(ctx context.Context, term int, cond func() bool) error {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		cm.mu.Lock()
+		if !cm.isLeader() || cm.currentTerm != term {
+			cm.mu.Unlock()
+			return ErrLeadershipLost
+		}
+		done := cond()
+		cm.mu.Unlock()
+		if done {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// SetLeaseRead enables or disables lease-based reads. With leases, a leader
+// that received heartbeat acknowledgements from a majority within the last
+// minimum election timeout minus maxClockDrift serves ReadIndex without a round of
+// heartbeats, relying on its peers not electing a new leader within that
+// window. maxClockDrift bounds how much faster the leader's clock may run than
+// its peers'.
+//
+// Every server in the cluster must enable lease reads: it is a follower with
+// them enabled that ignores RequestVote while it hears from a leader.
+func (cm *ConsensusModule) SetLeaseRead(enabled bool, maxClockDrift time.Duration) error {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if err := validateClockDrift(maxClockDrift, cm.config.ElectionTimeoutMin); err != nil {
+		return err
+	}
+	cm.config.LeaseRead = enabled
+	cm.config.MaxClockDrift = maxClockDrift
+	cm.leaseExpiry = time.Time{}
+	return nil
+}
+
+// extendLease moves the leader's lease forward to cover the latest
+// acknowledgements from a quorum. Expects cm.mu to be locked.
+func (cm *ConsensusModule) extendLease() {
+	if !cm.config.LeaseRead || !cm.isLeader() || cm.transferDone != nil {
+		return
+	}
+	now := time.Now()
+	acked := cm.configuration.quorumTime(func(id int) time.Time {
+		if id == cm.id {
+			return now
+		}
+		return cm.ackTime[id]
+	})
+	if acked.Before(cm.leaderStartTime) {
+		return
+	}
+	expiry := acked.Add(cm.config.ElectionTimeoutMin - cm.config.MaxClockDrift)
+	if expiry.After(cm.leaseExpiry) {
+		cm.leaseExpiry = expiry
+	}
+}
+
+// hasLease reports whether the leader currently holds a read lease. Expects
+// cm.mu to be locked.
+func (cm *ConsensusModule) hasLease() bool {
+	return cm.config.LeaseRead && cm.isLeader() && cm.transferDone == nil && time.Now().Before(cm.leaseExpiry)
+}
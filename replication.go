@@ -0,0 +1,346 @@
+package raft
+
+import "time"
+
+// replicator is the worker that replicates the leader's log to one peer.
+//
+// It starts in probe mode, with one request in flight at a time, until the
+// follower accepts an AppendEntries. From then on it pipelines: it advances
+// nextIndex as soon as it sends entries, without waiting for the reply, and
+// keeps up to Config.MaxInflightAppends requests in flight. A rejection, or a
+// request that fails, moves it back to probe mode. Heartbeats go out whatever
+// is in flight, so a slow request doesn't make the follower start an
+// election, but they carry no entries while the window is full.
+type replicator struct {
+	peerId int
+	wake   chan struct{}
+	stop   chan struct{}
+
+	// The fields below are protected by cm.mu.
+
+	probing bool
+	// epoch counts the switches to probe mode. Only replies to requests
+	// sent in the current epoch move nextIndex back.
+	epoch    int
+	inflight int
+	// heartbeatDue is set while the peer is owed a request, entries or not.
+	heartbeatDue bool
+}
+
+// notify wakes the replicator up. It never blocks.
+func (r *replicator) notify() {
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+// leaderSendAEs has the replicator of each peer send it an AppendEntries,
+// even if there are no new entries for it. It starts replicators for peers
+// that joined the configuration and stops those of peers that left it.
+func (cm *ConsensusModule) leaderSendAEs() {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if cm.state != Leader {
+		return
+	}
+
+	peerIds := cm.peers()
+	for peerId, r := range cm.replicators {
+		if !containsId(peerIds, peerId) {
+			close(r.stop)
+			delete(cm.replicators, peerId)
+		}
+	}
+	for _, peerId := range peerIds {
+		r, ok := cm.replicators[peerId]
+		if !ok {
+			r = &replicator{
+				peerId:  peerId,
+				wake:    make(chan struct{}, 1),
+				stop:    make(chan struct{}),
+				probing: true,
+			}
+			cm.replicators[peerId] = r
+			go cm.runReplicator(r, cm.currentTerm)
+		}
+		r.heartbeatDue = true
+		r.notify()
+	}
+}
+
+// stopReplication stops the replicators of the leader's term. Expects cm.mu
+// to be locked.
+func (cm *ConsensusModule) stopReplication() {
+	for _, r := range cm.replicators {
+		close(r.stop)
+	}
+	cm.replicators = make(map[int]*replicator)
+}
+
+func (cm *ConsensusModule) runReplicator(r *replicator, term int) {
+	cm.debug("replicator for %d started in term %d", r.peerId, term)
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-r.wake:
+		}
+		if delay := cm.config.AppendBatchDelay; delay > 0 {
+			// Let the Submits that follow this one go out in the same request.
+			select {
+			case <-r.stop:
+				return
+			case <-time.After(delay):
+			}
+		}
+
+		cm.mu.Lock()
+		if cm.state != Leader || cm.currentTerm != term {
+			cm.mu.Unlock()
+			return
+		}
+		cm.sendAppends(r, term)
+		cm.mu.Unlock()
+	}
+}
+
+// sendAppends sends the peer as many requests as its replicator's mode
+// allows. Expects cm.mu to be locked.
+func (cm *ConsensusModule) sendAppends(r *replicator, term int) {
+	for {
+		limit := cm.config.MaxInflightAppends
+		if r.probing {
+			limit = 1
+		}
+		full := r.inflight >= limit
+		if full && !r.heartbeatDue {
+			return
+		}
+
+		ni := cm.nextIndex[r.peerId]
+		if ni <= cm.lastIncludedIndex {
+			if !r.probing {
+				// The entries the peer needs next are gone; wait for the
+				// requests in flight before sending the snapshot.
+				cm.probe(r, ni)
+				continue
+			}
+			if full {
+				// The snapshot is in flight; a heartbeat from its end keeps the
+				// peer from starting an election however long it takes. Its
+				// reply doesn't belong to any epoch, so a rejection changes
+				// nothing.
+				args := AppendEntriesArgs{
+					Term:         term,
+					LeaderId:     cm.id,
+					PrevLogIndex: cm.lastIncludedIndex,
+					PrevLogTerm:  cm.lastIncludedTerm,
+					LeaderCommit: cm.commitIndex,
+				}
+				r.inflight++
+				r.heartbeatDue = false
+				go cm.leaderSendAE(r, args, -1)
+				return
+			}
+			args := InstallSnapshotArgs{
+				Term:              term,
+				LeaderId:          cm.id,
+				LastIncludedIndex: cm.lastIncludedIndex,
+				LastIncludedTerm:  cm.lastIncludedTerm,
+				Data:              cm.snapshot,
+				Configuration:     cm.snapshotConfiguration,
+			}
+			r.inflight++
+			r.heartbeatDue = false
+			go cm.leaderSendSnapshot(r, args)
+			return
+		}
+
+		var entries []LogEntry
+		if !full {
+			entries = cm.appendBatch(ni)
+		}
+		if len(entries) == 0 && !r.heartbeatDue {
+			return
+		}
+		args := AppendEntriesArgs{
+			Term:         term,
+			LeaderId:     cm.id,
+			PrevLogIndex: ni - 1,
+			PrevLogTerm:  cm.termAt(ni - 1),
+			Entries:      entries,
+			LeaderCommit: cm.commitIndex,
+		}
+		r.inflight++
+		r.heartbeatDue = false
+		if !r.probing {
+			cm.nextIndex[r.peerId] = ni + len(entries)
+		}
+		go cm.leaderSendAE(r, args, r.epoch)
+	}
+}
+
+// appendBatch returns the entries from index ni on that fit in one
+// AppendEntries. The first entry always does, however large. Expects cm.mu to
+// be locked.
+func (cm *ConsensusModule) appendBatch(ni int) []LogEntry {
+	entries := cm.log[cm.logPos(ni):]
+	if max := cm.config.MaxEntriesPerAppend; max > 0 && len(entries) > max {
+		entries = entries[:max]
+	}
+	if max := cm.config.MaxBytesPerAppend; max > 0 {
+		size := 0
+		for i, entry := range entries {
+			if size += entrySize(entry); size > max && i > 0 {
+				return entries[:i]
+			}
+		}
+	}
+	return entries
+}
+
+// appendEntryOverhead bounds the bytes an entry takes in an AppendEntries
+// besides its Data: the gob field tags, its term and its type.
+const appendEntryOverhead = 16
+
+// entrySize is the size entry counts for against MaxBytesPerAppend. A command
+// submitted as a Go value counts as the overhead alone, since measuring it
+// would mean encoding it.
+func entrySize(entry LogEntry) int {
+	return appendEntryOverhead + len(entry.Data)
+}
+
+// probe moves the replicator to probe mode, resuming from nextIndex. Expects
+// cm.mu to be locked.
+func (cm *ConsensusModule) probe(r *replicator, nextIndex int) {
+	r.probing = true
+	r.epoch++
+	cm.nextIndex[r.peerId] = intMax(nextIndex, cm.matchIndex[r.peerId]+1)
+}
+
+func (cm *ConsensusModule) leaderSendAE(r *replicator, args AppendEntriesArgs, epoch int) {
+	peerId := r.peerId
+	cm.debug("sending AppendEntries to %v: args=%+v", peerId, args)
+	var reply AppendEntriesReply
+	sentAt := time.Now()
+	err := cm.transport.AppendEntries(peerId, args, &reply)
+
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	r.inflight--
+	if err != nil {
+		// The entries may be lost. Find out where the peer is with the next
+		// heartbeat, rather than retrying straight away.
+		if epoch == r.epoch {
+			cm.probe(r, cm.matchIndex[peerId]+1)
+		}
+		return
+	}
+	if reply.Term > cm.currentTerm {
+		cm.debug("term out of date in heartbeat reply")
+		cm.becomeFollower(reply.Term)
+		return
+	}
+	if cm.state != Leader || args.Term != cm.currentTerm || reply.Term != cm.currentTerm {
+		return
+	}
+
+	cm.recordAck(peerId, sentAt)
+	if reply.Success {
+		if match := args.PrevLogIndex + len(args.Entries); match > cm.matchIndex[peerId] {
+			cm.matchIndex[peerId] = match
+		}
+		if cm.nextIndex[peerId] <= cm.matchIndex[peerId] {
+			cm.nextIndex[peerId] = cm.matchIndex[peerId] + 1
+		}
+		if epoch == r.epoch {
+			r.probing = false
+		}
+		if peerId == cm.transferTarget {
+			cm.maybeSendTimeoutNow()
+		}
+		cm.debug("AppendEntries reply from %d success: nextIndex := %d, matchIndex := %d", peerId, cm.nextIndex[peerId], cm.matchIndex[peerId])
+		cm.leaderAdvanceCommit()
+	} else if epoch == r.epoch && !r.probing && reply.ConflictTerm < 0 {
+		// The follower's log matched the leader's when the pipeline started,
+		// so it is only missing entries still in flight: this request
+		// overtook an earlier one. Send its entries again rather than
+		// probing.
+		if cm.nextIndex[peerId] > args.PrevLogIndex+1 {
+			cm.nextIndex[peerId] = args.PrevLogIndex + 1
+		}
+		cm.debug("AppendEntries reply from %d !success out of order: nextIndex := %d", peerId, cm.nextIndex[peerId])
+	} else if epoch == r.epoch {
+		nextIndex := reply.ConflictIndex
+		if reply.ConflictTerm >= 0 {
+			for i := cm.logLen() - 1; i > cm.lastIncludedIndex; i-- {
+				if cm.termAt(i) == reply.ConflictTerm {
+					nextIndex = i + 1
+					break
+				}
+			}
+		}
+		cm.probe(r, nextIndex)
+		cm.debug("AppendEntries reply from %d !success: nextIndex := %d", peerId, cm.nextIndex[peerId])
+	}
+	r.notify()
+}
+
+func (cm *ConsensusModule) leaderSendSnapshot(r *replicator, args InstallSnapshotArgs) {
+	peerId := r.peerId
+	cm.debug("sending InstallSnapshot to %v: lastIncludedIndex=%d, lastIncludedTerm=%d", peerId, args.LastIncludedIndex, args.LastIncludedTerm)
+	var reply InstallSnapshotReply
+	sentAt := time.Now()
+	err := cm.transport.InstallSnapshot(peerId, args, &reply)
+
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	r.inflight--
+	if err != nil {
+		return
+	}
+	if reply.Term > cm.currentTerm {
+		cm.debug("term out of date in InstallSnapshot reply")
+		cm.becomeFollower(reply.Term)
+		return
+	}
+
+	if cm.state == Leader && args.Term == reply.Term {
+		cm.recordAck(peerId, sentAt)
+		if cm.matchIndex[peerId] < args.LastIncludedIndex {
+			cm.matchIndex[peerId] = args.LastIncludedIndex
+		}
+		if cm.nextIndex[peerId] < args.LastIncludedIndex+1 {
+			cm.nextIndex[peerId] = args.LastIncludedIndex + 1
+		}
+		if peerId == cm.transferTarget {
+			cm.maybeSendTimeoutNow()
+		}
+		cm.debug("InstallSnapshot reply from %d: nextIndex := %d, matchIndex := %d", peerId, cm.nextIndex[peerId], cm.matchIndex[peerId])
+		r.notify()
+	}
+}
+
+// leaderAdvanceCommit commits the entries of the leader's term that a quorum
+// has replicated, along with the entries before them. Expects cm.mu to be
+// locked.
+func (cm *ConsensusModule) leaderAdvanceCommit() {
+	savedCommitIndex := cm.commitIndex
+	for i := cm.commitIndex + 1; i < cm.logLen(); i++ {
+		if cm.termAt(i) == cm.currentTerm && cm.configuration.hasQuorum(func(id int) bool {
+			return id == cm.id || cm.matchIndex[id] >= i
+		}) {
+			cm.commitIndex = i
+		}
+	}
+	if cm.commitIndex != savedCommitIndex {
+		cm.debug("leader sets commitIndex := %d", cm.commitIndex)
+		// Commit index changed: the leader considers new entries to be
+		// committed. Send new entries on the commit channel to this
+		// leader's clients, and notify followers by sending them AEs.
+		cm.notifyCommitReady()
+		cm.triggerAE()
+		cm.advanceConfiguration()
+	}
+}
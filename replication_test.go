@@ -0,0 +1,295 @@
+package raft
+
+import (
+	"bytes"
+	"encoding/gob"
+	"sync"
+	"testing"
+	"time"
+)
+
+// With one entry per AppendEntries and a slow network, only a pipeline keeps
+// up: waiting for each reply would take a round trip per entry.
+func TestPipelinedReplication(t *testing.T) {
+	network := NewSimNetwork(1, SimFaults{MinDelay: 50 * time.Millisecond, MaxDelay: 50 * time.Millisecond})
+	config := DefaultConfig()
+	config.MaxEntriesPerAppend = 1
+	config.AppendBatchDelay = 0
+	fsms := []*counterFSM{{}, {}, {}}
+	cms, stop := startInmemClusterWithFSMs(t, network.InmemNetwork, config, []FSM{fsms[0], fsms[1], fsms[2]})
+	defer stop()
+
+	leaderId := waitForLeader(cms)
+	if leaderId < 0 {
+		t.Fatalf("no leader elected")
+	}
+	const n = 80
+	start := time.Now()
+	for i := 1; i <= n; i++ {
+		if _, _, isLeader := cms[leaderId].Submit(1); !isLeader {
+			t.Fatalf("server %d lost leadership", leaderId)
+		}
+	}
+	for fsms[leaderId].get() < n {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("committed %d of %d entries", fsms[leaderId].get(), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// Waiting for each reply would take n*50ms.
+	if elapsed := time.Since(start); elapsed > n*50*time.Millisecond/2 {
+		t.Errorf("committing %d entries took %v", n, elapsed)
+	}
+}
+
+// A follower that missed entries is probed back to where its log matches the
+// leader's, and then catches up.
+func TestReplicationProbesLaggingFollower(t *testing.T) {
+	network := NewInmemNetwork()
+	fsms := []*counterFSM{{}, {}, {}}
+	cms, stop := startInmemClusterWithFSMs(t, network, DefaultConfig(), []FSM{fsms[0], fsms[1], fsms[2]})
+	defer stop()
+
+	leaderId := waitForLeader(cms)
+	if leaderId < 0 {
+		t.Fatalf("no leader elected")
+	}
+	followerId := (leaderId + 1) % 3
+	network.Disconnect(followerId)
+	for i := 0; i < 20; i++ {
+		cms[leaderId].Submit(1)
+	}
+	time.Sleep(200 * time.Millisecond)
+	network.Reconnect(followerId)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for fsms[followerId].get() < 20 {
+		if time.Now().After(deadline) {
+			t.Fatalf("follower applied %d of 20 entries", fsms[followerId].get())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// limitTransport records the largest AppendEntries a server sends, by entries
+// and by the bytes they take when gob-encoded on a connection, and the most it
+// has in flight to one peer.
+type limitTransport struct {
+	Transport
+
+	mu          sync.Mutex
+	enc         *gob.Encoder
+	buf         bytes.Buffer
+	inflight    map[int]int
+	maxInflight int
+	maxEntries  int
+	maxBytes    int
+}
+
+func newLimitTransport(transport Transport) *limitTransport {
+	t := &limitTransport{Transport: transport, inflight: make(map[int]int)}
+	t.enc = gob.NewEncoder(&t.buf)
+	// Send the types up front, as a connection does with its first request.
+	t.enc.Encode(AppendEntriesArgs{})
+	return t
+}
+
+// entryBytes returns the bytes the entries of args add to its encoding.
+// Expects t.mu to be locked.
+func (t *limitTransport) entryBytes(args AppendEntriesArgs) int {
+	t.buf.Reset()
+	t.enc.Encode(args)
+	withEntries := t.buf.Len()
+	args.Entries = nil
+	t.buf.Reset()
+	t.enc.Encode(args)
+	return withEntries - t.buf.Len()
+}
+
+func (t *limitTransport) AppendEntries(peerId int, args AppendEntriesArgs, reply *AppendEntriesReply) error {
+	t.mu.Lock()
+	if len(args.Entries) > 0 {
+		t.inflight[peerId]++
+		t.maxInflight = intMax(t.maxInflight, t.inflight[peerId])
+	}
+	t.maxEntries = intMax(t.maxEntries, len(args.Entries))
+	t.maxBytes = intMax(t.maxBytes, t.entryBytes(args))
+	t.mu.Unlock()
+
+	err := t.Transport.AppendEntries(peerId, args, reply)
+
+	if len(args.Entries) > 0 {
+		t.mu.Lock()
+		t.inflight[peerId]--
+		t.mu.Unlock()
+	}
+	return err
+}
+
+// A follower catching up after a partition gets the entries it missed in
+// AppendEntries within the limits, with few of them in flight at once. The
+// default limits apply to commands submitted as Go values too.
+func TestAppendEntriesFlowControl(t *testing.T) {
+	data := make([]byte, 100)
+	dataConfig := DefaultConfig()
+	dataConfig.MaxEntriesPerAppend = 5
+	dataConfig.MaxBytesPerAppend = 3 * (len(data) + appendEntryOverhead)
+	for _, tc := range []struct {
+		name       string
+		config     Config
+		n          int
+		submit     func(cm *ConsensusModule)
+		maxEntries int
+	}{
+		{"data", dataConfig, 100, func(cm *ConsensusModule) { cm.SubmitData(data) }, 3},
+		{"command", DefaultConfig(), 200, func(cm *ConsensusModule) { cm.Submit(1) }, DefaultConfig().MaxEntriesPerAppend},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			testAppendEntriesFlowControl(t, tc.config, tc.n, tc.submit, tc.maxEntries)
+		})
+	}
+}
+
+// testAppendEntriesFlowControl submits n entries with submit while a follower
+// is partitioned, and checks that the leader sends them to it in
+// AppendEntries of at most maxEntries entries, within the limits of config.
+func testAppendEntriesFlowControl(t *testing.T, config Config, n int, submit func(cm *ConsensusModule), maxEntries int) {
+	network := NewSimNetwork(1, SimFaults{MinDelay: time.Millisecond, MaxDelay: 10 * time.Millisecond})
+	config.MaxInflightAppends = 2
+	// The partitioned follower must not depose the leader when it comes back,
+	// or the new one may be missing the entries it is to catch up on.
+	config.PreVote = true
+
+	const servers = 3
+	fsms := make([]*counterFSM, servers)
+	transports := make([]*limitTransport, servers)
+	for id := range fsms {
+		fsms[id] = &counterFSM{}
+	}
+	cms, stop := startInmemClusterWrapped(t, network.InmemNetwork, config, []FSM{fsms[0], fsms[1], fsms[2]}, func(id int, transport Transport) Transport {
+		transports[id] = newLimitTransport(transport)
+		return transports[id]
+	})
+	defer stop()
+
+	leaderId := waitForLeader(cms)
+	if leaderId < 0 {
+		t.Fatalf("no leader elected")
+	}
+	followerId := (leaderId + 1) % servers
+	network.Disconnect(followerId)
+	for i := 0; i < n; i++ {
+		submit(cms[leaderId])
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for fsms[leaderId].get() < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("leader applied %d of %d entries", fsms[leaderId].get(), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	network.Reconnect(followerId)
+
+	deadline = time.Now().Add(5 * time.Second)
+	for fsms[followerId].get() < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("follower applied %d of %d entries", fsms[followerId].get(), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	leader := transports[leaderId]
+	leader.mu.Lock()
+	defer leader.mu.Unlock()
+	if leader.maxEntries > maxEntries || leader.maxBytes > config.MaxBytesPerAppend {
+		t.Errorf("leader sent up to %d entries and %d bytes in one AppendEntries, want at most %d and %d", leader.maxEntries, leader.maxBytes, maxEntries, config.MaxBytesPerAppend)
+	}
+	if leader.maxInflight > config.MaxInflightAppends {
+		t.Errorf("leader had %d AppendEntries in flight to a peer, want at most %d", leader.maxInflight, config.MaxInflightAppends)
+	}
+}
+
+// slowSnapshotTransport delays InstallSnapshot, and counts the AppendEntries
+// sent to a peer while a snapshot is on its way to it.
+type slowSnapshotTransport struct {
+	Transport
+	delay time.Duration
+
+	mu         sync.Mutex
+	sending    map[int]bool
+	heartbeats int
+}
+
+func (t *slowSnapshotTransport) InstallSnapshot(peerId int, args InstallSnapshotArgs, reply *InstallSnapshotReply) error {
+	t.mu.Lock()
+	t.sending[peerId] = true
+	t.mu.Unlock()
+	time.Sleep(t.delay)
+	err := t.Transport.InstallSnapshot(peerId, args, reply)
+	t.mu.Lock()
+	t.sending[peerId] = false
+	t.mu.Unlock()
+	return err
+}
+
+func (t *slowSnapshotTransport) AppendEntries(peerId int, args AppendEntriesArgs, reply *AppendEntriesReply) error {
+	t.mu.Lock()
+	if t.sending[peerId] {
+		t.heartbeats++
+	}
+	t.mu.Unlock()
+	return t.Transport.AppendEntries(peerId, args, reply)
+}
+
+// A follower keeps getting heartbeats while a snapshot that takes longer than
+// an election timeout is sent to it.
+func TestHeartbeatsDuringSlowSnapshot(t *testing.T) {
+	network := NewInmemNetwork()
+	config := DefaultConfig()
+	config.PreVote = true
+
+	const n = 3
+	fsms := make([]*counterFSM, n)
+	transports := make([]*slowSnapshotTransport, n)
+	for id := range fsms {
+		fsms[id] = &counterFSM{}
+	}
+	cms, stop := startInmemClusterWrapped(t, network, config, []FSM{fsms[0], fsms[1], fsms[2]}, func(id int, transport Transport) Transport {
+		transports[id] = &slowSnapshotTransport{Transport: transport, delay: 2 * config.ElectionTimeoutMax, sending: make(map[int]bool)}
+		return transports[id]
+	})
+	defer stop()
+
+	leaderId := waitForLeader(cms)
+	if leaderId < 0 {
+		t.Fatalf("no leader elected")
+	}
+	followerId := (leaderId + 1) % n
+	network.Disconnect(followerId)
+	for i := 0; i < 10; i++ {
+		cms[leaderId].Submit(1)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if err := cms[leaderId].TakeSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+	network.Reconnect(followerId)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for fsms[followerId].get() < 10 {
+		if time.Now().After(deadline) {
+			t.Fatalf("follower applied %d of 10 entries", fsms[followerId].get())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	leader := transports[leaderId]
+	leader.mu.Lock()
+	defer leader.mu.Unlock()
+	if leader.heartbeats == 0 {
+		t.Errorf("leader sent no heartbeats during a snapshot lasting %v", leader.delay)
+	}
+	if _, _, isLeader, _ := cms[leaderId].Report(); !isLeader {
+		t.Errorf("server %d lost leadership during the snapshot", leaderId)
+	}
+}
@@ -1,13 +1,14 @@
 package raft
 
-import (
-	"fmt"
-	"math/rand"
-	"time"
-)
+import "log"
 
+// RPCProxy exposes an RPCHandler over net/rpc. Incoming RPCs go through
+// faults, which can simulate an unreliable network.
 type RPCProxy struct {
-	cm *ConsensusModule
+	id      int
+	handler RPCHandler
+	faults  *FaultPolicy
+	logger  *log.Logger
 }
 
 type RequestVoteArgs struct {
@@ -15,6 +16,10 @@ type RequestVoteArgs struct {
 	CandidateId  int
 	LastLogIndex int
 	LastLogTerm  int
+
+	// LeadershipTransfer is set when the candidate campaigns because the
+	// leader sent it TimeoutNow.
+	LeadershipTransfer bool
 }
 
 type RequestVoteReply struct {
@@ -23,22 +28,10 @@ type RequestVoteReply struct {
 }
 
 func (p *RPCProxy) RequestVote(args RequestVoteArgs, reply *RequestVoteReply) error {
-	f := rand.Float32()
-	// 模拟 rpc 请求失败
-	if f < MockUnreliableRpcFailureRate {
-		p.cm.debug("drop RequestVote")
-		time.Sleep(time.Duration(MockUnreliableRpcFailureDuration) * TimeoutUnit)
-		return fmt.Errorf("RPC failed")
-	}
-	// 模拟网络延迟
-	if f < MockUnreliableRpcDelayRate {
-		p.cm.debug("delay RequestVote")
-		time.Sleep(time.Duration(MockUnreliableRpcDelayMin+rand.Intn(MockUnreliableRpcDelayMax-MockUnreliableRpcDelayMin)) * TimeoutUnit)
-	} else {
-		time.Sleep(time.Duration(MockUnreliableRpcLatencyMin+rand.Intn(MockUnreliableRpcLatencyMax-MockUnreliableRpcLatencyMin)) * TimeoutUnit)
+	if err := p.faults.apply(p.logger, p.id, args.CandidateId, "RequestVote"); err != nil {
+		return err
 	}
-
-	return p.cm.RequestVote(args, reply)
+	return p.handler.RequestVote(args, reply)
 }
 
 type AppendEntriesArgs struct {
@@ -58,19 +51,63 @@ type AppendEntriesReply struct {
 }
 
 func (p *RPCProxy) AppendEntries(args AppendEntriesArgs, reply *AppendEntriesReply) error {
-	f := rand.Float32()
-	// 模拟 rpc 请求失败
-	if f < MockUnreliableRpcFailureRate {
-		p.cm.debug("drop RequestVote")
-		time.Sleep(time.Duration(MockUnreliableRpcFailureDuration) * TimeoutUnit)
-		return fmt.Errorf("RPC failed")
+	if err := p.faults.apply(p.logger, p.id, args.LeaderId, "AppendEntries"); err != nil {
+		return err
 	}
-	// 模拟网络延迟
-	if f < MockUnreliableRpcDelayRate {
-		p.cm.debug("delay RequestVote")
-		time.Sleep(time.Duration(MockUnreliableRpcDelayMin+rand.Intn(MockUnreliableRpcDelayMax-MockUnreliableRpcDelayMin)) * TimeoutUnit)
-	} else {
-		time.Sleep(time.Duration(MockUnreliableRpcLatencyMin+rand.Intn(MockUnreliableRpcLatencyMax-MockUnreliableRpcLatencyMin)) * TimeoutUnit)
+	return p.handler.AppendEntries(args, reply)
+}
+
+type InstallSnapshotArgs struct {
+	Term              int
+	LeaderId          int
+	LastIncludedIndex int
+	LastIncludedTerm  int
+	Data              []byte
+	Configuration     Configuration
+}
+
+type InstallSnapshotReply struct {
+	Term int
+}
+
+func (p *RPCProxy) InstallSnapshot(args InstallSnapshotArgs, reply *InstallSnapshotReply) error {
+	if err := p.faults.apply(p.logger, p.id, args.LeaderId, "InstallSnapshot"); err != nil {
+		return err
+	}
+	return p.handler.InstallSnapshot(args, reply)
+}
+
+type TimeoutNowArgs struct {
+	Term     int
+	LeaderId int
+}
+
+type TimeoutNowReply struct {
+	Term int
+}
+
+func (p *RPCProxy) TimeoutNow(args TimeoutNowArgs, reply *TimeoutNowReply) error {
+	if err := p.faults.apply(p.logger, p.id, args.LeaderId, "TimeoutNow"); err != nil {
+		return err
+	}
+	return p.handler.TimeoutNow(args, reply)
+}
+
+type PreVoteArgs struct {
+	Term         int
+	CandidateId  int
+	LastLogIndex int
+	LastLogTerm  int
+}
+
+type PreVoteReply struct {
+	Term        int
+	VoteGranted bool
+}
+
+func (p *RPCProxy) PreVote(args PreVoteArgs, reply *PreVoteReply) error {
+	if err := p.faults.apply(p.logger, p.id, args.CandidateId, "PreVote"); err != nil {
+		return err
 	}
-	return p.cm.AppendEntries(args, reply)
+	return p.handler.PreVote(args, reply)
 }
@@ -1,27 +1,35 @@
 package raft
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"net/rpc"
 	"sync"
+	"time"
 )
 
+var ErrForwardTimeout = errors.New("raft: the leader did not answer a forwarded Submit in time")
+
+// Server runs a ConsensusModule and carries its RPCs over net/rpc; it is the
+// ConsensusModule's Transport.
 type Server struct {
 	mu sync.Mutex
 
 	serverId int
 	peerIds  []int
+	config   Config
 
 	cm       *ConsensusModule
 	rpcProxy *RPCProxy
 	storage  Storage
 
+	faults    *FaultPolicy
 	rpcServer *rpc.Server
 	listener  net.Listener
 
-	commitChan  chan<- CommitEntry
+	fsm         FSM
 	peerClients map[int]*rpc.Client
 
 	ready <-chan interface{}
@@ -29,33 +37,53 @@ type Server struct {
 	wg    sync.WaitGroup
 }
 
-func NewServer(serverId int, peerIds []int, storage Storage, ready <-chan interface{}, commitChan chan<- CommitEntry) *Server {
+// NewServer creates a server that sends committed entries on commitChan,
+// returning an error if config is invalid.
+func NewServer(serverId int, peerIds []int, config Config, storage Storage, ready <-chan interface{}, commitChan chan<- CommitEntry) (*Server, error) {
+	return NewServerWithFSM(serverId, peerIds, config, storage, ready, NewChannelFSM(commitChan))
+}
+
+// NewServerWithFSM is like NewServer, but applies committed entries to fsm.
+func NewServerWithFSM(serverId int, peerIds []int, config Config, storage Storage, ready <-chan interface{}, fsm FSM) (*Server, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
 	s := new(Server)
 	s.serverId = serverId
 	s.peerIds = peerIds
+	s.config = config
 	s.peerClients = make(map[int]*rpc.Client)
 	s.ready = ready
 	s.quit = make(chan interface{})
-	s.commitChan = commitChan
+	s.fsm = fsm
 	s.storage = storage
-	return s
+	s.faults = NewFaultPolicy()
+	s.rpcServer = rpc.NewServer()
+	if err := s.rpcServer.RegisterName("Server", &serverRPC{s}); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// NewJoiningServer creates a server that is not part of any configuration yet.
+// It does not campaign until a leader adds it with AddServer.
+func NewJoiningServer(serverId int, config Config, storage Storage, ready <-chan interface{}, commitChan chan<- CommitEntry) (*Server, error) {
+	return NewServer(serverId, nil, config, storage, ready, commitChan)
 }
 
 func (s *Server) Serve() {
 	s.mu.Lock()
-	s.cm = NewConsensusModule(s.serverId, s.peerIds, s, s.ready, s.storage, s.commitChan)
-
-	s.rpcServer = rpc.NewServer()
-	s.rpcProxy = &RPCProxy{cm: s.cm}
-	err := s.rpcServer.RegisterName("ConsensusModule", s.rpcProxy)
+	var err error
+	s.cm, err = NewConsensusModule(s.serverId, s.peerIds, s.config, s, s.ready, s.storage, s.fsm)
 	if err != nil {
 		log.Fatal(err)
 	}
+
 	s.listener, err = net.Listen("tcp", ":0")
 	if err != nil {
 		log.Fatal(err)
 	}
-	log.Printf("[%v] listening at %s", s.serverId, s.listener.Addr())
+	s.config.logger().Printf("[%v] listening at %s", s.serverId, s.listener.Addr())
 	s.mu.Unlock()
 
 	s.wg.Add(1)
@@ -145,3 +173,159 @@ func (s *Server) Call(id int, serviceMethod string, args interface{}, reply inte
 	}
 	return peer.Call(serviceMethod, args, reply)
 }
+
+// callTimeout is like Call, but gives up with ErrForwardTimeout after
+// timeout.
+func (s *Server) callTimeout(id int, serviceMethod string, args interface{}, reply interface{}, timeout time.Duration) error {
+	s.mu.Lock()
+	peer := s.peerClients[id]
+	s.mu.Unlock()
+
+	if peer == nil {
+		return fmt.Errorf("call client %d after it's closed", id)
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	call := peer.Go(serviceMethod, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		return call.Error
+	case <-timer.C:
+		return ErrForwardTimeout
+	}
+}
+
+// Submit is like ConsensusModule.Submit, except that a server that is not the
+// leader forwards command to the leader it last heard from, waiting at most
+// Config.ForwardTimeout for the answer. It fails with ErrNotLeader if no
+// leader is known or the leader refuses the command.
+func (s *Server) Submit(command interface{}) (index int, term int, err error) {
+	return s.submit(ProposeArgs{Command: command})
+}
+
+// SubmitData is like Submit for a command the application has encoded
+// itself, as with ConsensusModule.SubmitData.
+func (s *Server) SubmitData(data []byte) (index int, term int, err error) {
+	return s.submit(ProposeArgs{Data: data, IsData: true})
+}
+
+func (s *Server) submit(args ProposeArgs) (int, int, error) {
+	cm := s.ConsensusModule()
+	index, term, isLeader := cm.submitEntry(LogEntry{Command: args.Command, Data: args.Data, IsData: args.IsData})
+	if isLeader {
+		return index, term, nil
+	}
+	_, _, _, leaderId := cm.Report()
+	if leaderId < 0 || leaderId == s.serverId {
+		return -1, term, ErrNotLeader
+	}
+	var reply ProposeReply
+	if err := s.callTimeout(leaderId, "Server.Propose", args, &reply, s.config.ForwardTimeout); err != nil {
+		return -1, term, err
+	}
+	if !reply.IsLeader {
+		return -1, reply.Term, ErrNotLeader
+	}
+	return reply.Index, reply.Term, nil
+}
+
+type ProposeArgs struct {
+	Command interface{}
+	Data    []byte
+	IsData  bool
+}
+
+type ProposeReply struct {
+	Index    int
+	Term     int
+	IsLeader bool
+}
+
+// serverRPC serves the RPCs between Servers that are not part of the
+// consensus protocol.
+type serverRPC struct {
+	s *Server
+}
+
+// Propose submits a command forwarded by another server. It does not forward
+// it again, so a command is never passed around between servers.
+func (r *serverRPC) Propose(args ProposeArgs, reply *ProposeReply) error {
+	cm := r.s.ConsensusModule()
+	if cm == nil {
+		return errors.New("raft: server is not serving yet")
+	}
+	reply.Index, reply.Term, reply.IsLeader = cm.submitEntry(LogEntry{Command: args.Command, Data: args.Data, IsData: args.IsData})
+	return nil
+}
+
+// ConsensusModule returns the ConsensusModule started by Serve.
+func (s *Server) ConsensusModule() *ConsensusModule {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cm
+}
+
+// Faults returns the policy for disturbing the RPCs this server receives. It
+// is disabled unless enabled by the caller.
+func (s *Server) Faults() *FaultPolicy {
+	return s.faults
+}
+
+// Register registers handler with the RPC server. It is called by
+// NewConsensusModule, while s.mu is held by Serve.
+func (s *Server) Register(handler RPCHandler) {
+	s.rpcProxy = &RPCProxy{id: s.serverId, handler: handler, faults: s.faults, logger: s.config.logger()}
+	if err := s.rpcServer.RegisterName("ConsensusModule", s.rpcProxy); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func (s *Server) RequestVote(peerId int, args RequestVoteArgs, reply *RequestVoteReply) error {
+	return s.Call(peerId, "ConsensusModule.RequestVote", args, reply)
+}
+
+func (s *Server) PreVote(peerId int, args PreVoteArgs, reply *PreVoteReply) error {
+	return s.Call(peerId, "ConsensusModule.PreVote", args, reply)
+}
+
+func (s *Server) AppendEntries(peerId int, args AppendEntriesArgs, reply *AppendEntriesReply) error {
+	return s.Call(peerId, "ConsensusModule.AppendEntries", args, reply)
+}
+
+func (s *Server) InstallSnapshot(peerId int, args InstallSnapshotArgs, reply *InstallSnapshotReply) error {
+	return s.Call(peerId, "ConsensusModule.InstallSnapshot", args, reply)
+}
+
+func (s *Server) TimeoutNow(peerId int, args TimeoutNowArgs, reply *TimeoutNowReply) error {
+	return s.Call(peerId, "ConsensusModule.TimeoutNow", args, reply)
+}
+
+// AddServer connects to the server at addr and adds it to the cluster. It
+// returns once the configuration change has committed.
+func (s *Server) AddServer(serverId int, addr net.Addr) error {
+	if err := s.ConnectToPeer(serverId, addr); err != nil {
+		return err
+	}
+	return s.cm.AddServer(serverId)
+}
+
+// AddLearner connects to the server at addr and adds it to the cluster as a
+// non-voting learner. It returns once the configuration change has committed.
+func (s *Server) AddLearner(serverId int, addr net.Addr) error {
+	if err := s.ConnectToPeer(serverId, addr); err != nil {
+		return err
+	}
+	return s.cm.AddLearner(serverId)
+}
+
+// PromoteLearner makes a caught-up learner a voter. It returns once the
+// configuration change has committed.
+func (s *Server) PromoteLearner(serverId int) error {
+	return s.cm.PromoteLearner(serverId)
+}
+
+// RemoveServer removes a server from the cluster. It returns once the
+// configuration change has committed.
+func (s *Server) RemoveServer(serverId int) error {
+	return s.cm.RemoveServer(serverId)
+}
@@ -0,0 +1,189 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+var (
+	ErrSessionExpired = errors.New("raft: client session expired or was never registered")
+	ErrStaleSequence  = errors.New("raft: command is older than the last one applied in its session")
+)
+
+func init() {
+	gob.Register(RegisterSession{})
+	gob.Register(SessionCommand{})
+}
+
+// RegisterSession is the command that opens a client session. The session's
+// client ID is the log index it was applied at.
+type RegisterSession struct {
+	// Timestamp is the leader's clock, in Unix nanoseconds, when the command
+	// was proposed.
+	Timestamp int64
+}
+
+// SessionCommand wraps a command sent in a client session. A client numbers
+// its commands from 1 and reuses the number when it retries one, so the
+// command is applied at most once.
+type SessionCommand struct {
+	ClientID  int
+	Seq       int
+	Timestamp int64
+	Command   interface{}
+}
+
+// RegisterSession opens a client session, returning its client ID.
+func (cm *ConsensusModule) RegisterSession(ctx context.Context) (int, error) {
+	_, result, err := cm.ProposeAndWait(ctx, RegisterSession{Timestamp: time.Now().UnixNano()})
+	if err != nil {
+		return -1, err
+	}
+	clientID, ok := result.(int)
+	if !ok {
+		return -1, errors.New("raft: sessions need the FSM to be wrapped by NewSessionFSM")
+	}
+	return clientID, nil
+}
+
+// ProposeInSession is like ProposeAndWait for command number seq of the
+// session clientID. If that command was already applied, it returns the
+// result it had then without applying it again.
+func (cm *ConsensusModule) ProposeInSession(ctx context.Context, clientID int, seq int, command interface{}) (interface{}, error) {
+	_, result, err := cm.ProposeAndWait(ctx, SessionCommand{
+		ClientID:  clientID,
+		Seq:       seq,
+		Timestamp: time.Now().UnixNano(),
+		Command:   command,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err, ok := result.(sessionError); ok {
+		return nil, err.err
+	}
+	return result, nil
+}
+
+// sessionError is the result of a SessionCommand the SessionFSM refused.
+type sessionError struct {
+	err error
+}
+
+type session struct {
+	LastSeq    int
+	LastResult interface{}
+	LastActive int64
+}
+
+// SessionFSM wraps an FSM to implement client sessions. It applies each
+// SessionCommand to the inner FSM once, caching its result for retries, and
+// forwards other commands unchanged. A session expires once timeout has
+// passed without a command in it, measured with the timestamps carried by
+// the log so that every replica expires it at the same entry.
+//
+// Cached results are part of the snapshot, so their types must be registered
+// with gob.
+type SessionFSM struct {
+	mu       sync.Mutex
+	fsm      FSM
+	timeout  time.Duration
+	sessions map[int]*session
+	// now is the latest timestamp applied.
+	now int64
+}
+
+func NewSessionFSM(fsm FSM, timeout time.Duration) *SessionFSM {
+	return &SessionFSM{
+		fsm:      fsm,
+		timeout:  timeout,
+		sessions: make(map[int]*session),
+	}
+}
+
+func (f *SessionFSM) Apply(entry CommitEntry) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch cmd := entry.Command.(type) {
+	case RegisterSession:
+		f.advance(cmd.Timestamp)
+		f.sessions[entry.Index] = &session{LastActive: f.now}
+		return entry.Index
+	case SessionCommand:
+		f.advance(cmd.Timestamp)
+		s, ok := f.sessions[cmd.ClientID]
+		if !ok {
+			return sessionError{ErrSessionExpired}
+		}
+		s.LastActive = f.now
+		if cmd.Seq == s.LastSeq {
+			return s.LastResult
+		}
+		if cmd.Seq < s.LastSeq {
+			return sessionError{ErrStaleSequence}
+		}
+		entry.Command = cmd.Command
+		s.LastSeq = cmd.Seq
+		s.LastResult = f.fsm.Apply(entry)
+		return s.LastResult
+	default:
+		return f.fsm.Apply(entry)
+	}
+}
+
+// advance moves the session clock to timestamp, if that is later, and
+// expires the sessions that have been idle for longer than the timeout.
+// Expects f.mu to be locked.
+func (f *SessionFSM) advance(timestamp int64) {
+	if timestamp > f.now {
+		f.now = timestamp
+	}
+	for id, s := range f.sessions {
+		if f.now-s.LastActive > int64(f.timeout) {
+			delete(f.sessions, id)
+		}
+	}
+}
+
+// sessionSnapshot is the snapshot of a SessionFSM.
+type sessionSnapshot struct {
+	Sessions map[int]*session
+	Now      int64
+	FSM      []byte
+}
+
+func (f *SessionFSM) Snapshot() ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	inner, err := f.fsm.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	var data bytes.Buffer
+	err = gob.NewEncoder(&data).Encode(sessionSnapshot{Sessions: f.sessions, Now: f.now, FSM: inner})
+	return data.Bytes(), err
+}
+
+func (f *SessionFSM) Restore(snapshot io.Reader) error {
+	var s sessionSnapshot
+	if err := gob.NewDecoder(snapshot).Decode(&s); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.fsm.Restore(bytes.NewReader(s.FSM)); err != nil {
+		return err
+	}
+	f.sessions = s.Sessions
+	if f.sessions == nil {
+		f.sessions = make(map[int]*session)
+	}
+	f.now = s.Now
+	return nil
+}
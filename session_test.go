@@ -0,0 +1,60 @@
+package raft
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSessionFSMDeduplicatesAndExpires(t *testing.T) {
+	counter := &counterFSM{}
+	fsm := NewSessionFSM(counter, time.Minute)
+	start := time.Now().UnixNano()
+	index := 0
+	apply := func(command interface{}) interface{} {
+		index++
+		return fsm.Apply(CommitEntry{Index: index, Term: 1, Command: command})
+	}
+
+	clientID := apply(RegisterSession{Timestamp: start}).(int)
+	if got := apply(SessionCommand{ClientID: clientID, Seq: 1, Timestamp: start, Command: 5}); got != 5 {
+		t.Errorf("first command returned %v, want 5", got)
+	}
+	// A retry of the same command returns the cached result without
+	// applying it again.
+	if got := apply(SessionCommand{ClientID: clientID, Seq: 1, Timestamp: start, Command: 5}); got != 5 {
+		t.Errorf("retried command returned %v, want 5", got)
+	}
+	if got := apply(SessionCommand{ClientID: clientID, Seq: 2, Timestamp: start, Command: 3}); got != 8 {
+		t.Errorf("second command returned %v, want 8", got)
+	}
+	if got := apply(SessionCommand{ClientID: clientID, Seq: 1, Timestamp: start, Command: 5}); got != (sessionError{ErrStaleSequence}) {
+		t.Errorf("stale command returned %v, want %v", got, ErrStaleSequence)
+	}
+	if counter.get() != 8 {
+		t.Errorf("counter is %d, want 8", counter.get())
+	}
+
+	// Sessions survive a snapshot.
+	data, err := fsm.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := NewSessionFSM(&counterFSM{}, time.Minute)
+	if err := restored.Restore(bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if got := restored.Apply(CommitEntry{Index: 10, Command: SessionCommand{ClientID: clientID, Seq: 2, Timestamp: start, Command: 3}}); got != 8 {
+		t.Errorf("retried command after restore returned %v, want 8", got)
+	}
+
+	// Another session's entry, timestamped past the timeout, expires the idle
+	// session.
+	later := start + int64(2*time.Minute)
+	apply(RegisterSession{Timestamp: later})
+	got := apply(SessionCommand{ClientID: clientID, Seq: 3, Timestamp: later, Command: 1})
+	if err, ok := got.(sessionError); !ok || !errors.Is(err.err, ErrSessionExpired) {
+		t.Errorf("command in an expired session returned %v, want %v", got, ErrSessionExpired)
+	}
+}
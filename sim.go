@@ -0,0 +1,191 @@
+package raft
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+// SimFaults describes the faults a SimNetwork injects. Rates are
+// probabilities in [0, 1] applied to each message independently.
+type SimFaults struct {
+	DropRate      float64
+	DuplicateRate float64
+	// ReorderRate is the chance a message is held back for an extra MaxDelay,
+	// letting messages sent after it on the same link overtake it.
+	ReorderRate float64
+
+	// Each message, and each duplicate, is delayed by a duration drawn from
+	// [MinDelay, MaxDelay].
+	MinDelay time.Duration
+	MaxDelay time.Duration
+}
+
+// SimEvent records what a SimNetwork did with one message.
+type SimEvent struct {
+	From, To int
+	// Seq numbers the messages sent from From to To, starting at 0.
+	Seq    int
+	Method string
+	// At is when the message was sent, since the network was created.
+	At time.Duration
+
+	Delay      time.Duration
+	Dropped    bool
+	Duplicated bool
+	Reordered  bool
+}
+
+// SimNetwork is an InmemNetwork whose messages go through a seeded scheduler
+// that drops, delays, reorders and duplicates them. Each link draws from its
+// own random source derived from the seed, so the fate of the n-th message
+// from one server to another depends only on the seed.
+//
+// Messages are delayed on the clock of the time package, which the servers'
+// timers use too. Run the cluster in a testing/synctest bubble, with
+// Config.RandSeed set, and that clock is virtual: deliveries and timeouts
+// happen in an order that depends only on the seeds, so a run that fails can
+// be replayed by passing its seed to NewSimNetwork again.
+type SimNetwork struct {
+	*InmemNetwork
+	scheduler *simScheduler
+}
+
+func NewSimNetwork(seed int64, faults SimFaults) *SimNetwork {
+	scheduler := &simScheduler{
+		start:  time.Now(),
+		seed:   seed,
+		faults: faults,
+		links:  make(map[[2]int]*simLink),
+	}
+	network := NewInmemNetwork()
+	network.scheduler = scheduler
+	return &SimNetwork{InmemNetwork: network, scheduler: scheduler}
+}
+
+// Seed returns the seed the network was created with.
+func (n *SimNetwork) Seed() int64 {
+	return n.scheduler.seed
+}
+
+// Trace returns the messages sent so far, in the order they were sent.
+// Messages sent at the same time are ordered by link and sequence number,
+// rather than by which sender got to the scheduler first.
+func (n *SimNetwork) Trace() []SimEvent {
+	n.scheduler.mu.Lock()
+	trace := append([]SimEvent(nil), n.scheduler.trace...)
+	n.scheduler.mu.Unlock()
+	sort.SliceStable(trace, func(i, j int) bool {
+		a, b := trace[i], trace[j]
+		if a.At != b.At {
+			return a.At < b.At
+		}
+		if a.From != b.From {
+			return a.From < b.From
+		}
+		if a.To != b.To {
+			return a.To < b.To
+		}
+		return a.Seq < b.Seq
+	})
+	return trace
+}
+
+type simScheduler struct {
+	mu     sync.Mutex
+	start  time.Time
+	seed   int64
+	faults SimFaults
+	links  map[[2]int]*simLink
+	trace  []SimEvent
+}
+
+type simLink struct {
+	rand *rand.Rand
+	seq  int
+}
+
+// schedule decides the fate of the next message from one server to another,
+// returning it along with the delay of its duplicate, if any.
+func (s *simScheduler) schedule(from, to int, method string) (SimEvent, time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := [2]int{from, to}
+	link, ok := s.links[key]
+	if !ok {
+		link = &simLink{rand: rand.New(rand.NewSource(s.seed ^ int64(from)<<32 ^ int64(to)))}
+		s.links[key] = link
+	}
+
+	// Always draw the same number of values, so that each message consumes
+	// the same part of the link's random sequence whatever its fate.
+	r := link.rand
+	ev := SimEvent{
+		From:       from,
+		To:         to,
+		Seq:        link.seq,
+		Method:     method,
+		At:         time.Since(s.start),
+		Dropped:    r.Float64() < s.faults.DropRate,
+		Duplicated: r.Float64() < s.faults.DuplicateRate,
+		Reordered:  r.Float64() < s.faults.ReorderRate,
+		Delay:      s.delay(r),
+	}
+	dupDelay := s.delay(r)
+	link.seq++
+
+	if ev.Dropped {
+		ev.Duplicated = false
+	}
+	if ev.Reordered {
+		ev.Delay += s.faults.MaxDelay
+	}
+	s.trace = append(s.trace, ev)
+	return ev, dupDelay
+}
+
+func (s *simScheduler) delay(r *rand.Rand) time.Duration {
+	spread := s.faults.MaxDelay - s.faults.MinDelay
+	if spread <= 0 {
+		return s.faults.MinDelay
+	}
+	return s.faults.MinDelay + time.Duration(r.Int63n(int64(spread)+1))
+}
+
+// deliver sends a message from one server to peer as scheduled.
+func (s *simScheduler) deliver(from int, peer *InmemTransport, args interface{}, reply interface{}) error {
+	ev, dupDelay := s.schedule(from, peer.id, rpcName(args))
+	time.Sleep(ev.Delay)
+	if ev.Dropped {
+		return fmt.Errorf("sim: dropped %s from %d to %d", ev.Method, ev.From, ev.To)
+	}
+	if ev.Duplicated {
+		go func() {
+			time.Sleep(dupDelay)
+			// Nobody waits for the duplicate's reply.
+			_ = peer.send(args, reflect.New(reflect.TypeOf(reply).Elem()).Interface())
+		}()
+	}
+	return peer.send(args, reply)
+}
+
+func rpcName(args interface{}) string {
+	switch args.(type) {
+	case RequestVoteArgs:
+		return "RequestVote"
+	case PreVoteArgs:
+		return "PreVote"
+	case AppendEntriesArgs:
+		return "AppendEntries"
+	case InstallSnapshotArgs:
+		return "InstallSnapshot"
+	case TimeoutNowArgs:
+		return "TimeoutNow"
+	default:
+		return fmt.Sprintf("%T", args)
+	}
+}
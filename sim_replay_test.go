@@ -0,0 +1,71 @@
+//go:build go1.25
+
+//go:debug asynctimerchan=0
+
+package raft
+
+import (
+	"reflect"
+	"testing"
+	"testing/synctest"
+	"time"
+)
+
+// simRun runs a cluster on a SimNetwork with the given seed in a synctest
+// bubble, where time is virtual, submitting a few commands and partitioning
+// the leader along the way. It returns the network's trace.
+func simRun(t *testing.T, seed int64) []SimEvent {
+	var trace []SimEvent
+	synctest.Test(t, func(t *testing.T) {
+		network := NewSimNetwork(seed, SimFaults{
+			DropRate:      0.1,
+			DuplicateRate: 0.1,
+			ReorderRate:   0.1,
+			MinDelay:      time.Millisecond,
+			MaxDelay:      10 * time.Millisecond,
+		})
+		config := DefaultConfig()
+		config.RandSeed = seed
+		fsms := []*counterFSM{{}, {}, {}}
+		cms, stop := startInmemClusterWithFSMs(t, network.InmemNetwork, config, []FSM{fsms[0], fsms[1], fsms[2]})
+
+		leaderId := waitForLeader(cms)
+		if leaderId < 0 {
+			t.Fatalf("no leader elected")
+		}
+		for i := 0; i < 5; i++ {
+			cms[leaderId].Submit(1)
+		}
+		time.Sleep(200 * time.Millisecond)
+		network.Disconnect(leaderId)
+		time.Sleep(time.Second)
+		network.Reconnect(leaderId)
+		time.Sleep(time.Second)
+
+		stop()
+		trace = network.Trace()
+		// Give the servers' goroutines time to notice they stopped.
+		time.Sleep(time.Second)
+	})
+	return trace
+}
+
+func TestSimNetworkReplaysClusterRun(t *testing.T) {
+	const seed = 7
+	first := simRun(t, seed)
+	if len(first) == 0 {
+		t.Fatalf("no messages in the trace")
+	}
+	second := simRun(t, seed)
+	if !reflect.DeepEqual(first, second) {
+		for i := range first {
+			if i >= len(second) || first[i] != second[i] {
+				t.Fatalf("runs with seed %d diverge at message %d of %d: %+v, then %+v", seed, i, len(first), first[i], second[i:intMin(i+1, len(second))])
+			}
+		}
+		t.Fatalf("the second run with seed %d sent %d messages, the first %d", seed, len(second), len(first))
+	}
+	if other := simRun(t, seed+1); reflect.DeepEqual(first, other) {
+		t.Errorf("seeds %d and %d produced the same trace", seed, seed+1)
+	}
+}
@@ -0,0 +1,90 @@
+package raft
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSimNetworkReplaysFromSeed(t *testing.T) {
+	faults := SimFaults{
+		DropRate:      0.2,
+		DuplicateRate: 0.2,
+		ReorderRate:   0.2,
+		MinDelay:      time.Millisecond,
+		MaxDelay:      20 * time.Millisecond,
+	}
+	run := func(seed int64) []SimEvent {
+		var events []SimEvent
+		sched := NewSimNetwork(seed, faults).scheduler
+		for i := 0; i < 100; i++ {
+			ev, _ := sched.schedule(i%3, (i+1)%3, "AppendEntries")
+			// Only the faults depend on the seed here, not the send times.
+			ev.At = 0
+			events = append(events, ev)
+		}
+		return events
+	}
+
+	first := run(7)
+	if !reflect.DeepEqual(first, run(7)) {
+		t.Errorf("two runs with seed 7 scheduled different faults")
+	}
+	if reflect.DeepEqual(first, run(8)) {
+		t.Errorf("seeds 7 and 8 scheduled the same faults")
+	}
+	var dropped, duplicated, reordered int
+	for _, ev := range first {
+		if ev.Dropped {
+			dropped++
+		}
+		if ev.Duplicated {
+			duplicated++
+		}
+		if ev.Reordered {
+			reordered++
+		}
+	}
+	if dropped == 0 || duplicated == 0 || reordered == 0 {
+		t.Errorf("got %d drops, %d duplicates and %d reorders in 100 messages", dropped, duplicated, reordered)
+	}
+}
+
+func TestSimNetworkCommitsUnderFaults(t *testing.T) {
+	const seed = 1
+	network := NewSimNetwork(seed, SimFaults{
+		DropRate:      0.1,
+		DuplicateRate: 0.1,
+		ReorderRate:   0.1,
+		MinDelay:      time.Millisecond,
+		MaxDelay:      10 * time.Millisecond,
+	})
+	config := DefaultConfig()
+	config.RandSeed = seed
+	cms, commitChans, stop := startInmemCluster(t, network.InmemNetwork, 3, config)
+	defer stop()
+
+	var leaderId int
+	for {
+		if leaderId = waitForLeader(cms); leaderId < 0 {
+			t.Fatalf("no leader elected")
+		}
+		if _, _, isLeader := cms[leaderId].Submit(42); isLeader {
+			break
+		}
+	}
+
+	for id := range cms {
+		select {
+		case entry := <-commitChans[id]:
+			if entry.Command != 42 {
+				t.Errorf("server %d committed %v, want 42", id, entry.Command)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("server %d did not commit the command", id)
+		}
+	}
+	if len(network.Trace()) == 0 {
+		t.Errorf("no messages in the trace")
+	}
+}
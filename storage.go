@@ -3,9 +3,10 @@ package raft
 import "sync"
 
 type Storage interface {
-	Set(ky string, value []byte)
-	Get(key string) ([]byte, bool)
-	HasData() bool
+	Set(key string, value []byte) error
+	Get(key string) ([]byte, bool, error)
+	Delete(key string) error
+	HasData() (bool, error)
 }
 
 type MapStorage struct {
@@ -20,21 +21,29 @@ func NewMapStorage() *MapStorage {
 	}
 }
 
-func (ms *MapStorage) Get(key string) ([]byte, bool) {
+func (ms *MapStorage) Get(key string) ([]byte, bool, error) {
 	ms.mu.Lock()
 	defer ms.mu.Unlock()
 	v, found := ms.m[key]
-	return v, found
+	return v, found, nil
 }
 
-func (ms *MapStorage) Set(key string, value []byte) {
+func (ms *MapStorage) Set(key string, value []byte) error {
 	ms.mu.Lock()
 	defer ms.mu.Unlock()
 	ms.m[key] = value
+	return nil
 }
 
-func (ms *MapStorage) HasData() bool {
+func (ms *MapStorage) Delete(key string) error {
 	ms.mu.Lock()
 	defer ms.mu.Unlock()
-	return len(ms.m) > 0
+	delete(ms.m, key)
+	return nil
+}
+
+func (ms *MapStorage) HasData() (bool, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return len(ms.m) > 0, nil
 }
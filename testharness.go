@@ -1,6 +1,9 @@
 package raft
 
 import (
+	"bytes"
+	"errors"
+	"io"
 	"log"
 	"math/rand"
 	"sync"
@@ -20,13 +23,8 @@ type Harness struct {
 	cluster []*Server
 	storage []*MapStorage
 
-	// commitChans has a channel per server in cluster with the commi channel for
-	// that server.
-	commitChans []chan CommitEntry
-
 	// commits at index i holds the sequence of commits made by server i so far.
-	// It is populated by goroutines that listen on the corresponding commitChans
-	// channel.
+	// It is populated by the harnessFSM of that server.
 	commits [][]CommitEntry
 
 	// connected has a bool per server in cluster, specifying whether this server
@@ -34,6 +32,10 @@ type Harness struct {
 	// will pass to or from it).
 	connected []bool
 
+	config Config
+	// reliable is set when the servers simulate no network faults.
+	reliable bool
+
 	n int
 	t *testing.T
 }
@@ -41,12 +43,28 @@ type Harness struct {
 // NewHarness creates a new test Harness, initialized with n servers connected
 // to each other.
 func NewHarness(t *testing.T, n int) *Harness {
+	return NewHarnessWithConfig(t, n, DefaultConfig())
+}
+
+// NewHarnessWithConfig is like NewHarness, but runs the servers with config.
+func NewHarnessWithConfig(t *testing.T, n int, config Config) *Harness {
+	return NewHarnessWithFSMs(t, config, make([]FSM, n))
+}
+
+// NewHarnessWithFSMs creates a Harness with a server per FSM in fsms, each
+// applying its commits to that FSM as well as recording them.
+func NewHarnessWithFSMs(t *testing.T, config Config, fsms []FSM) *Harness {
+	n := len(fsms)
 	ns := make([]*Server, n)
 	connected := make([]bool, n)
 	ready := make(chan interface{})
-	commitChans := make([]chan CommitEntry, n)
 	storages := make([]*MapStorage, n)
-	commits := make([][]CommitEntry, n)
+	h := &Harness{
+		commits: make([][]CommitEntry, n),
+		config:  config,
+		n:       n,
+		t:       t,
+	}
 
 	// Create all Servers in this cluster, assign ids and peer ids.
 	for i := 0; i < n; i++ {
@@ -58,8 +76,12 @@ func NewHarness(t *testing.T, n int) *Harness {
 		}
 
 		storages[i] = NewMapStorage()
-		commitChans[i] = make(chan CommitEntry)
-		ns[i] = NewServer(i, peerIds, storages[i], ready, commitChans[i])
+		var err error
+		ns[i], err = NewServerWithFSM(i, peerIds, config, storages[i], ready, &harnessFSM{h: h, id: i, fsm: fsms[i]})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ns[i].Faults().SetEnabled(true)
 		ns[i].Serve()
 	}
 
@@ -74,19 +96,11 @@ func NewHarness(t *testing.T, n int) *Harness {
 	}
 	close(ready)
 
-	h := &Harness{
-		cluster:     ns,
-		storage:     storages,
-		commitChans: commitChans,
-		commits:     commits,
-		connected:   connected,
-		n:           n,
-		t:           t,
-	}
-
-	for i := 0; i < n; i++ {
-		go h.collectCommits(i)
-	}
+	h.mu.Lock()
+	h.cluster = ns
+	h.storage = storages
+	h.connected = connected
+	h.mu.Unlock()
 	return h
 }
 
@@ -100,13 +114,110 @@ func (h *Harness) Shutdown() {
 	}
 }
 
+// Faults returns the fault policy of server id. Every server in the harness
+// starts out simulating an unreliable network.
+func (h *Harness) Faults(id int) *FaultPolicy {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.cluster[id].Faults()
+}
+
+// SetReliable turns the simulated network faults off for every server,
+// including those that join later, or back on. Tests that are not about
+// faults use it so that a dropped RPC doesn't change the leader under them.
+func (h *Harness) SetReliable(reliable bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.reliable = reliable
+	for _, s := range h.cluster {
+		s.Faults().SetEnabled(!reliable)
+	}
+}
+
+// AddServer starts a new server, connects it to the rest of the cluster and
+// asks leaderId to add it to the configuration. It returns the new server's id.
+func (h *Harness) AddServer(leaderId int) (int, error) {
+	id := h.startJoiningServer()
+	tlog("Add server %d through %d", id, leaderId)
+	return id, h.cluster[leaderId].AddServer(id, h.cluster[id].GetListenAddr())
+}
+
+// AddLearner is like AddServer, but adds the new server as a learner.
+func (h *Harness) AddLearner(leaderId int) (int, error) {
+	id := h.startJoiningServer()
+	tlog("Add learner %d through %d", id, leaderId)
+	return id, h.cluster[leaderId].AddLearner(id, h.cluster[id].GetListenAddr())
+}
+
+// startJoiningServer starts a server outside the configuration and connects
+// it to the rest of the cluster.
+func (h *Harness) startJoiningServer() int {
+	h.mu.Lock()
+	id := h.n
+	ready := make(chan interface{})
+	close(ready)
+	storage := NewMapStorage()
+	s, err := NewServerWithFSM(id, nil, h.config, storage, ready, &harnessFSM{h: h, id: id})
+	if err != nil {
+		h.mu.Unlock()
+		h.t.Fatal(err)
+	}
+	s.Faults().SetEnabled(!h.reliable)
+	s.Serve()
+
+	h.cluster = append(h.cluster, s)
+	h.storage = append(h.storage, storage)
+	h.commits = append(h.commits, nil)
+	h.connected = append(h.connected, true)
+	h.n++
+	h.mu.Unlock()
+
+	for j := 0; j < id; j++ {
+		if err := s.ConnectToPeer(j, h.cluster[j].GetListenAddr()); err != nil {
+			h.t.Fatal(err)
+		}
+		if err := h.cluster[j].ConnectToPeer(id, s.GetListenAddr()); err != nil {
+			h.t.Fatal(err)
+		}
+	}
+	return id
+}
+
+// DisconnectPeer disconnects a server from all other servers in the cluster.
+func (h *Harness) DisconnectPeer(id int) {
+	tlog("Disconnect %d", id)
+	h.cluster[id].DisconnectAll()
+	for j := 0; j < h.n; j++ {
+		if j != id {
+			h.cluster[j].DisconnectPeer(id)
+		}
+	}
+	h.connected[id] = false
+}
+
+// ReconnectPeer connects a server to all other servers in the cluster.
+func (h *Harness) ReconnectPeer(id int) {
+	tlog("Reconnect %d", id)
+	for j := 0; j < h.n; j++ {
+		if j != id {
+			if err := h.cluster[id].ConnectToPeer(j, h.cluster[j].GetListenAddr()); err != nil {
+				h.t.Fatal(err)
+			}
+			if err := h.cluster[j].ConnectToPeer(id, h.cluster[id].GetListenAddr()); err != nil {
+				h.t.Fatal(err)
+			}
+		}
+	}
+	h.connected[id] = true
+}
+
 func (h *Harness) CheckSingleLeader() (int, int) {
 	for r := 0; r < 5; r++ {
 		leaderId := -1
 		leaderTerm := -1
 		for i := 0; i < h.n; i++ {
 			if h.connected[i] {
-				_, term, isLeader := h.cluster[i].cm.Report()
+				_, term, isLeader, _ := h.cluster[i].cm.Report()
 				if isLeader {
 					if leaderId < 0 {
 						leaderId = i
@@ -127,16 +238,186 @@ func (h *Harness) CheckSingleLeader() (int, int) {
 	return -1, -1
 }
 
-func (h *Harness) collectCommits(i int) {
-	for c := range h.commitChans[i] {
+// WaitForLeader polls the connected servers until one of them is the leader,
+// and returns its id and term. Unlike CheckSingleLeader, it gives split votes
+// until timeout to resolve.
+func (h *Harness) WaitForLeader(timeout time.Duration) (int, int) {
+	deadline := time.Now().Add(timeout)
+	for {
+		leaderId, leaderTerm := -1, -1
+		for i := 0; i < h.n; i++ {
+			if h.connected[i] {
+				_, term, isLeader, _ := h.cluster[i].cm.Report()
+				if !isLeader {
+					continue
+				}
+				if leaderId >= 0 && term == leaderTerm {
+					h.t.Fatalf("both %d and %d are leaders in term %d", leaderId, i, term)
+				}
+				if term > leaderTerm {
+					leaderId, leaderTerm = i, term
+				}
+			}
+		}
+		if leaderId >= 0 {
+			return leaderId, leaderTerm
+		}
+		if time.Now().After(deadline) {
+			h.t.Fatalf("no leader elected within %v", timeout)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// Server returns server id of the cluster.
+func (h *Harness) Server(id int) *Server {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.cluster[id]
+}
+
+// harnessFSM records the commits of server id in the harness before passing
+// them on to fsm, if set.
+type harnessFSM struct {
+	h   *Harness
+	id  int
+	fsm FSM
+}
+
+func (f *harnessFSM) record(c CommitEntry) {
+	f.h.mu.Lock()
+	defer f.h.mu.Unlock()
+	tlog("commit on %d: %+v", f.id, c)
+	f.h.commits[f.id] = append(f.h.commits[f.id], c)
+}
+
+func (f *harnessFSM) Apply(entry CommitEntry) interface{} {
+	f.record(entry)
+	if f.fsm == nil {
+		return nil
+	}
+	return f.fsm.Apply(entry)
+}
+
+func (f *harnessFSM) Snapshot() ([]byte, error) {
+	if f.fsm == nil {
+		return nil, errors.New("harness server has no FSM to snapshot")
+	}
+	return f.fsm.Snapshot()
+}
+
+func (f *harnessFSM) Restore(snapshot io.Reader) error {
+	data, err := io.ReadAll(snapshot)
+	if err != nil {
+		return err
+	}
+	return f.restoreAt(CommitEntry{Index: -1, Term: -1, Snapshot: data})
+}
+
+func (f *harnessFSM) restoreAt(entry CommitEntry) error {
+	f.record(entry)
+	if f.fsm == nil {
+		return nil
+	}
+	if r, ok := f.fsm.(snapshotRestorer); ok {
+		return r.restoreAt(entry)
+	}
+	return f.fsm.Restore(bytes.NewReader(entry.Snapshot))
+}
+
+// SubmitToServer submits the command to serverId.
+func (h *Harness) SubmitToServer(serverId int, cmd interface{}) bool {
+	_, _, isLeader := h.cluster[serverId].cm.Submit(cmd)
+	return isLeader
+}
+
+// CheckCommittedN verifies that cmd was committed by exactly n connected
+// servers.
+func (h *Harness) CheckCommittedN(cmd interface{}, n int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if nc := h.countCommitted(commandMatcher(cmd)); nc != n {
+		h.t.Errorf("CheckCommittedN got nc=%d for cmd=%v, want n=%d", nc, cmd, n)
+	}
+}
+
+// WaitForCommittedN is like CheckCommittedN, but gives the servers up to
+// timeout to commit cmd, since a dropped RPC delays a commit by a heartbeat
+// or more.
+func (h *Harness) WaitForCommittedN(cmd interface{}, n int, timeout time.Duration) {
+	if nc, ok := h.waitForCommitted(commandMatcher(cmd), n, timeout); !ok {
+		h.t.Errorf("WaitForCommittedN got nc=%d for cmd=%v within %v, want n=%d", nc, cmd, timeout, n)
+	}
+}
+
+// WaitForCommittedData is like WaitForCommittedN for a command submitted with
+// SubmitData.
+func (h *Harness) WaitForCommittedData(data []byte, n int, timeout time.Duration) {
+	match := func(c CommitEntry) bool {
+		return c.IsData && c.Data != nil && bytes.Equal(c.Data, data)
+	}
+	if nc, ok := h.waitForCommitted(match, n, timeout); !ok {
+		h.t.Errorf("WaitForCommittedData got nc=%d for data=%q within %v, want n=%d", nc, data, timeout, n)
+	}
+}
+
+// waitForCommitted waits up to timeout for exactly n connected servers to
+// commit an entry matching match. It returns the last count, and whether it
+// was n.
+func (h *Harness) waitForCommitted(match func(c CommitEntry) bool, n int, timeout time.Duration) (int, bool) {
+	deadline := time.Now().Add(timeout)
+	for {
 		h.mu.Lock()
-		tlog("collectCommits(%d) got %+v", i, c)
-		h.commits[i] = append(h.commits[i], c)
+		nc := h.countCommitted(match)
 		h.mu.Unlock()
+		if nc == n {
+			return nc, true
+		}
+		if time.Now().After(deadline) {
+			return nc, false
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func commandMatcher(cmd interface{}) func(c CommitEntry) bool {
+	return func(c CommitEntry) bool { return c.Command == cmd }
+}
+
+// countCommitted returns the number of connected servers that committed an
+// entry matching match. Expects h.mu to be locked.
+func (h *Harness) countCommitted(match func(c CommitEntry) bool) int {
+	nc := 0
+	for i := 0; i < h.n; i++ {
+		if !h.connected[i] {
+			continue
+		}
+		for _, c := range h.commits[i] {
+			if c.Snapshot == nil && match(c) {
+				nc++
+				break
+			}
+		}
+	}
+	return nc
+}
+
+// LastCommit returns the last entry committed by server i so far.
+func (h *Harness) LastCommit(i int) (CommitEntry, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.commits[i]) == 0 {
+		return CommitEntry{}, false
 	}
+	return h.commits[i][len(h.commits[i])-1], true
 }
 
 func tlog(format string, a ...interface{}) {
 	format = "[TEST] " + format
 	log.Printf(format, a...)
 }
+
+func sleepMs(n int) {
+	time.Sleep(time.Duration(n) * time.Millisecond)
+}
@@ -0,0 +1,138 @@
+package raft
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrTransferInProgress = errors.New("raft: a leadership transfer is already in progress")
+	ErrTransferTimeout    = errors.New("raft: leadership transfer timed out")
+)
+
+// TransferLeadership hands leadership over to targetId. The leader stops
+// accepting new commands, brings the target's log up to date and then tells
+// it to start an election immediately with a TimeoutNow RPC. It returns nil
+// once this server hears from the target as the new leader. It returns
+// ErrLeadershipLost if this server steps down and another server takes over,
+// or it doesn't learn who did within an election timeout, and
+// ErrTransferTimeout if it is still the leader by then.
+func (cm *ConsensusModule) TransferLeadership(targetId int) error {
+	cm.mu.Lock()
+	if !cm.isLeader() {
+		cm.mu.Unlock()
+		return ErrNotLeader
+	}
+	if cm.transferDone != nil {
+		cm.mu.Unlock()
+		return ErrTransferInProgress
+	}
+	if targetId == cm.id || !cm.configuration.isVoter(targetId) {
+		cm.mu.Unlock()
+		return fmt.Errorf("raft: cannot transfer leadership to %d", targetId)
+	}
+	cm.debug("transferring leadership to %d", targetId)
+	cm.leaseExpiry = time.Time{}
+	done := make(chan error, 1)
+	cm.transferTarget = targetId
+	cm.transferDone = done
+	cm.maybeSendTimeoutNow()
+	cm.mu.Unlock()
+	cm.triggerAE()
+
+	timer := time.NewTimer(cm.config.ElectionTimeoutMax)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+	}
+
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if cm.transferDone == done {
+		cm.debug("leadership transfer to %d timed out", targetId)
+		if cm.isLeader() {
+			cm.abortTransfer(ErrTransferTimeout)
+		} else {
+			cm.abortTransfer(ErrLeadershipLost)
+		}
+	}
+	return <-done
+}
+
+// maybeSendTimeoutNow sends TimeoutNow to the transfer target once its log
+// matches the leader's. Expects cm.mu to be locked.
+func (cm *ConsensusModule) maybeSendTimeoutNow() {
+	if cm.transferDone == nil || cm.timeoutNowSent {
+		return
+	}
+	lastLogIndex, _ := cm.lastLogIndexAndTerm()
+	if cm.matchIndex[cm.transferTarget] != lastLogIndex {
+		return
+	}
+	cm.timeoutNowSent = true
+	targetId := cm.transferTarget
+	args := TimeoutNowArgs{
+		Term:     cm.currentTerm,
+		LeaderId: cm.id,
+	}
+	go func() {
+		cm.debug("sending TimeoutNow to %d: %+v", targetId, args)
+		var reply TimeoutNowReply
+		if err := cm.transport.TimeoutNow(targetId, args, &reply); err != nil {
+			cm.mu.Lock()
+			defer cm.mu.Unlock()
+			if cm.transferTarget == targetId {
+				cm.timeoutNowSent = false
+			}
+		}
+	}()
+}
+
+// abortTransfer ends the leadership transfer in progress, reporting err to
+// TransferLeadership. Expects cm.mu to be locked.
+func (cm *ConsensusModule) abortTransfer(err error) {
+	if cm.transferDone == nil {
+		return
+	}
+	cm.transferDone <- err
+	cm.transferDone = nil
+	cm.transferTarget = -1
+	cm.timeoutNowSent = false
+}
+
+// observeTransferLeader ends the leadership transfer this server started, if
+// any, once it has stepped down and hears from leaderId as the new leader:
+// the transfer succeeded if that is the target. Expects cm.mu to be locked.
+func (cm *ConsensusModule) observeTransferLeader(leaderId int) {
+	if cm.transferDone == nil || cm.isLeader() {
+		return
+	}
+	if leaderId == cm.transferTarget {
+		cm.abortTransfer(nil)
+	} else {
+		cm.abortTransfer(ErrLeadershipLost)
+	}
+}
+
+func (cm *ConsensusModule) TimeoutNow(args TimeoutNowArgs, reply *TimeoutNowReply) error {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	if cm.isDead() {
+		return nil
+	}
+	if cm.isFailed() {
+		return cm.err
+	}
+	cm.debug("TimeoutNow: %+v [currentTerm=%d]", args, cm.currentTerm)
+
+	reply.Term = cm.currentTerm
+	if args.Term != cm.currentTerm || !cm.isFollower() || !cm.configuration.isVoter(cm.id) {
+		return nil
+	}
+	cm.startElection(true)
+	return nil
+}
@@ -0,0 +1,205 @@
+package raft
+
+import (
+	"fmt"
+	"sync"
+)
+
+// RPCHandler handles the RPCs a ConsensusModule receives from its peers.
+// ConsensusModule implements it.
+type RPCHandler interface {
+	RequestVote(args RequestVoteArgs, reply *RequestVoteReply) error
+	PreVote(args PreVoteArgs, reply *PreVoteReply) error
+	AppendEntries(args AppendEntriesArgs, reply *AppendEntriesReply) error
+	InstallSnapshot(args InstallSnapshotArgs, reply *InstallSnapshotReply) error
+	TimeoutNow(args TimeoutNowArgs, reply *TimeoutNowReply) error
+}
+
+// Transport carries RPCs between the ConsensusModules of a cluster. Server is
+// the net/rpc implementation; InmemTransport connects servers in the same
+// process.
+type Transport interface {
+	// Register sets the handler for RPCs sent to this server. The
+	// ConsensusModule registers itself when it is created.
+	Register(handler RPCHandler)
+
+	RequestVote(peerId int, args RequestVoteArgs, reply *RequestVoteReply) error
+	PreVote(peerId int, args PreVoteArgs, reply *PreVoteReply) error
+	AppendEntries(peerId int, args AppendEntriesArgs, reply *AppendEntriesReply) error
+	InstallSnapshot(peerId int, args InstallSnapshotArgs, reply *InstallSnapshotReply) error
+	TimeoutNow(peerId int, args TimeoutNowArgs, reply *TimeoutNowReply) error
+}
+
+// InmemNetwork connects InmemTransports in the same process, passing RPCs
+// through channels instead of sockets.
+type InmemNetwork struct {
+	mu         sync.Mutex
+	transports map[int]*InmemTransport
+	// disconnected holds the servers that are cut off from all others.
+	disconnected map[int]bool
+	// scheduler, if set, decides the fate of every message; see SimNetwork.
+	scheduler *simScheduler
+}
+
+func NewInmemNetwork() *InmemNetwork {
+	return &InmemNetwork{
+		transports:   make(map[int]*InmemTransport),
+		disconnected: make(map[int]bool),
+	}
+}
+
+// Transport returns the transport of server id, creating it if needed.
+func (n *InmemNetwork) Transport(id int) *InmemTransport {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if t, ok := n.transports[id]; ok {
+		return t
+	}
+	t := &InmemTransport{
+		id:       id,
+		network:  n,
+		requests: make(chan *inmemRequest),
+		quit:     make(chan struct{}),
+	}
+	n.transports[id] = t
+	go t.serve()
+	return t
+}
+
+// Disconnect cuts server id off from all other servers.
+func (n *InmemNetwork) Disconnect(id int) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.disconnected[id] = true
+}
+
+// Reconnect undoes Disconnect.
+func (n *InmemNetwork) Reconnect(id int) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delete(n.disconnected, id)
+}
+
+func (n *InmemNetwork) route(from, to int) (*InmemTransport, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.disconnected[from] || n.disconnected[to] {
+		return nil, fmt.Errorf("server %d is disconnected from %d", from, to)
+	}
+	t, ok := n.transports[to]
+	if !ok {
+		return nil, fmt.Errorf("no server %d on the network", to)
+	}
+	return t, nil
+}
+
+type inmemRequest struct {
+	args  interface{}
+	reply interface{}
+	done  chan error
+}
+
+// InmemTransport is a Transport over an InmemNetwork.
+type InmemTransport struct {
+	mu      sync.Mutex
+	id      int
+	network *InmemNetwork
+	handler RPCHandler
+
+	requests chan *inmemRequest
+	quit     chan struct{}
+	closed   sync.Once
+}
+
+func (t *InmemTransport) Register(handler RPCHandler) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.handler = handler
+}
+
+// Close stops delivering RPCs to this transport's handler.
+func (t *InmemTransport) Close() {
+	t.closed.Do(func() { close(t.quit) })
+}
+
+func (t *InmemTransport) RequestVote(peerId int, args RequestVoteArgs, reply *RequestVoteReply) error {
+	return t.call(peerId, args, reply)
+}
+
+func (t *InmemTransport) PreVote(peerId int, args PreVoteArgs, reply *PreVoteReply) error {
+	return t.call(peerId, args, reply)
+}
+
+func (t *InmemTransport) AppendEntries(peerId int, args AppendEntriesArgs, reply *AppendEntriesReply) error {
+	// The receiver keeps the entries, so don't let it share the sender's log.
+	args.Entries = append([]LogEntry(nil), args.Entries...)
+	return t.call(peerId, args, reply)
+}
+
+func (t *InmemTransport) InstallSnapshot(peerId int, args InstallSnapshotArgs, reply *InstallSnapshotReply) error {
+	return t.call(peerId, args, reply)
+}
+
+func (t *InmemTransport) TimeoutNow(peerId int, args TimeoutNowArgs, reply *TimeoutNowReply) error {
+	return t.call(peerId, args, reply)
+}
+
+func (t *InmemTransport) call(peerId int, args interface{}, reply interface{}) error {
+	peer, err := t.network.route(t.id, peerId)
+	if err != nil {
+		return err
+	}
+	if sched := t.network.scheduler; sched != nil {
+		return sched.deliver(t.id, peer, args, reply)
+	}
+	return peer.send(args, reply)
+}
+
+func (t *InmemTransport) send(args interface{}, reply interface{}) error {
+	req := &inmemRequest{args: args, reply: reply, done: make(chan error, 1)}
+	select {
+	case t.requests <- req:
+	case <-t.quit:
+		return fmt.Errorf("server %d is closed", t.id)
+	}
+	return <-req.done
+}
+
+// serve hands each incoming request to the handler on its own goroutine, so a
+// slow RPC doesn't hold up the others.
+func (t *InmemTransport) serve() {
+	for {
+		select {
+		case req := <-t.requests:
+			go func() {
+				req.done <- t.dispatch(req.args, req.reply)
+			}()
+		case <-t.quit:
+			return
+		}
+	}
+}
+
+func (t *InmemTransport) dispatch(args interface{}, reply interface{}) error {
+	t.mu.Lock()
+	handler := t.handler
+	t.mu.Unlock()
+	if handler == nil {
+		return fmt.Errorf("server %d has no handler registered", t.id)
+	}
+
+	switch args := args.(type) {
+	case RequestVoteArgs:
+		return handler.RequestVote(args, reply.(*RequestVoteReply))
+	case PreVoteArgs:
+		return handler.PreVote(args, reply.(*PreVoteReply))
+	case AppendEntriesArgs:
+		return handler.AppendEntries(args, reply.(*AppendEntriesReply))
+	case InstallSnapshotArgs:
+		return handler.InstallSnapshot(args, reply.(*InstallSnapshotReply))
+	case TimeoutNowArgs:
+		return handler.TimeoutNow(args, reply.(*TimeoutNowReply))
+	default:
+		return fmt.Errorf("unknown RPC %T", args)
+	}
+}
@@ -0,0 +1,104 @@
+package raft
+
+import (
+	"testing"
+	"time"
+)
+
+// startInmemCluster starts n ConsensusModules talking over network, each
+// sending its commits on a channel. The returned function stops them.
+func startInmemCluster(t *testing.T, network *InmemNetwork, n int, config Config) ([]*ConsensusModule, []chan CommitEntry, func()) {
+	commitChans := make([]chan CommitEntry, n)
+	fsms := make([]FSM, n)
+	for id := range fsms {
+		commitChans[id] = make(chan CommitEntry, 16)
+		fsms[id] = NewChannelFSM(commitChans[id])
+	}
+	cms, stop := startInmemClusterWithFSMs(t, network, config, fsms)
+	return cms, commitChans, stop
+}
+
+// startInmemClusterWithFSMs is like startInmemCluster, with a server per FSM
+// in fsms.
+func startInmemClusterWithFSMs(t *testing.T, network *InmemNetwork, config Config, fsms []FSM) ([]*ConsensusModule, func()) {
+	return startInmemClusterWrapped(t, network, config, fsms, nil)
+}
+
+// startInmemClusterWrapped is like startInmemClusterWithFSMs, with each
+// server sending its RPCs through the transport wrap returns for it, if wrap
+// is not nil.
+func startInmemClusterWrapped(t *testing.T, network *InmemNetwork, config Config, fsms []FSM, wrap func(id int, transport Transport) Transport) ([]*ConsensusModule, func()) {
+	n := len(fsms)
+	ready := make(chan interface{})
+	cms := make([]*ConsensusModule, n)
+	for id := 0; id < n; id++ {
+		var peerIds []int
+		for p := 0; p < n; p++ {
+			if p != id {
+				peerIds = append(peerIds, p)
+			}
+		}
+		var transport Transport = network.Transport(id)
+		if wrap != nil {
+			transport = wrap(id, transport)
+		}
+		cm, err := NewConsensusModule(id, peerIds, config, transport, ready, NewMapStorage(), fsms[id])
+		if err != nil {
+			t.Fatal(err)
+		}
+		cms[id] = cm
+	}
+	close(ready)
+	return cms, func() {
+		for id, cm := range cms {
+			cm.Stop()
+			network.Transport(id).Close()
+		}
+	}
+}
+
+// waitForLeader returns the id of a leader among cms, or -1 if none shows up
+// within five seconds.
+func waitForLeader(cms []*ConsensusModule) int {
+	for attempt := 0; attempt < 50; attempt++ {
+		time.Sleep(100 * time.Millisecond)
+		for _, cm := range cms {
+			if id, _, isLeader, _ := cm.Report(); isLeader {
+				return id
+			}
+		}
+	}
+	return -1
+}
+
+func TestInmemTransportElectsAndCommits(t *testing.T) {
+	network := NewInmemNetwork()
+	cms, commitChans, stop := startInmemCluster(t, network, 3, DefaultConfig())
+	defer stop()
+
+	leaderId := waitForLeader(cms)
+	if leaderId < 0 {
+		t.Fatalf("no leader elected over the in-memory transport")
+	}
+
+	// A disconnected follower misses the command and catches up once it is
+	// reconnected.
+	followerId := (leaderId + 1) % len(cms)
+	network.Disconnect(followerId)
+	if _, _, isLeader := cms[leaderId].Submit(42); !isLeader {
+		t.Fatalf("leader %d refused Submit", leaderId)
+	}
+	time.Sleep(500 * time.Millisecond)
+	network.Reconnect(followerId)
+
+	for id := range cms {
+		select {
+		case entry := <-commitChans[id]:
+			if entry.Command != 42 {
+				t.Errorf("server %d committed %v, want 42", id, entry.Command)
+			}
+		case <-time.After(3 * time.Second):
+			t.Errorf("server %d did not commit the command", id)
+		}
+	}
+}